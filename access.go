@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Formats of the access log.
+const (
+	accessFormatGlog     = "glog"     // The fields of the glog line, space separated.
+	accessFormatJSON     = "json"     // One accessEntry JSON object per line.
+	accessFormatCombined = "combined" // Apache combined, plus our own fields.
+)
+
+// AccessLog writes a line for each http request in the given Format,
+// one of glog, json or combined, to Out. If Out is nil lines are
+// written to the glog info log instead.
+type AccessLog struct {
+	Format string
+	Out    io.Writer
+
+	mu sync.Mutex // Serializes writes to Out.
+}
+
+// accessEntry is what the access log has about an http request.
+type accessEntry struct {
+	Time      time.Time
+	RemoteIP  string
+	Proto     string
+	Method    string
+	Path      string // Escaped, with the query.
+	Status    int
+	Bytes     int
+	Duration  float64 // In milliseconds.
+	UserAgent string  `json:",omitempty"`
+	Referer   string  `json:",omitempty"`
+	RequestID string  `json:",omitempty"`
+	TraceID   string  `json:",omitempty"`
+	Upstreams int     // Upstream servers the request was fanned out to.
+	Failed    int     // Upstream servers that failed, see recordFanout.
+}
+
+// parseAccessFormat checks the name of an access log format.
+func parseAccessFormat(s string) (string, error) {
+	switch s {
+	case accessFormatGlog, accessFormatJSON, accessFormatCombined:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid access log format %q", s)
+}
+
+// openAccessLog returns the writer of the access log at dest, which is
+// either "stderr", "syslog" for the local syslog daemon, or the name of
+// a file rotated as per maxSize and maxAge, see rotatingFile.
+func openAccessLog(dest string, maxSize int64, maxAge time.Duration, keep int) (io.Writer, error) {
+	switch dest {
+	case "stderr":
+		return os.Stderr, nil
+	case "syslog":
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "sv-api-aggregator")
+	}
+	f := &rotatingFile{Name: dest, MaxSize: maxSize, MaxAge: maxAge, Keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// log writes the entry e to the access log.
+func (l *AccessLog) log(e *accessEntry) {
+	var line string
+	switch l.Format {
+	case accessFormatJSON:
+		b, err := json.Marshal(e)
+		if err != nil {
+			glog.Errorf("access log: %v", err)
+			return
+		}
+		line = string(b)
+	case accessFormatCombined:
+		line = combinedLine(e)
+	default:
+		line = fmt.Sprintf("%s %d %q %q %s %db %s %s %s %q %q %d %d",
+			e.Proto,
+			e.Status,
+			e.Method,
+			e.Path,
+			e.RemoteIP,
+			e.Bytes,
+			time.Duration(e.Duration*float64(time.Millisecond)),
+			orDash(e.RequestID),
+			orDash(e.TraceID),
+			e.UserAgent,
+			e.Referer,
+			e.Upstreams,
+			e.Failed,
+		)
+		if l.Out != nil {
+			line = e.Time.Format(time.RFC3339Nano) + " " + line
+		}
+	}
+	if l.Out == nil {
+		glog.Info(line)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.Out, line+"\n"); err != nil {
+		glog.Errorf("access log: %v", err)
+	}
+}
+
+// combinedLine formats e in the Apache combined log format, followed
+// by the request ID, fan-out count and failed upstream servers.
+func combinedLine(e *accessEntry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.Itoa(e.Bytes)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s %s %d %d",
+		e.RemoteIP,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Proto),
+		e.Status,
+		size,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		orDash(e.RequestID),
+		e.Upstreams,
+		e.Failed,
+	)
+}
+
+// Close closes Out, unless it is os.Stderr or can't be closed.
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.Out.(io.Closer); ok && l.Out != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// fanoutKey is the context key of the fan-out counters of a request.
+type fanoutKey struct{}
+
+// fanoutCounters counts the upstream servers a request was fanned out
+// to, and how many of them failed. Updated atomically.
+type fanoutCounters struct {
+	upstreams int64
+	failed    int64
+}
+
+// recordFanout records that the request with the given context was
+// fanned out to n upstream servers, of which failed did not answer or
+// rejected the request, for the access log.
+func recordFanout(ctx context.Context, n, failed int) {
+	if c, ok := ctx.Value(fanoutKey{}).(*fanoutCounters); ok {
+		atomic.AddInt64(&c.upstreams, int64(n))
+		atomic.AddInt64(&c.failed, int64(failed))
+	}
+}
+
+// rotatingFile is an io.Writer to the file Name, which is rotated when
+// it would grow over MaxSize bytes or when it was opened more than
+// MaxAge ago, if they are set. Rotated files are renamed with the
+// time of the rotation as suffix, and only the latest Keep are kept,
+// or all of them if zero.
+type rotatingFile struct {
+	Name    string
+	MaxSize int64
+	MaxAge  time.Duration
+	Keep    int
+
+	mu     sync.Mutex // Guards the below.
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// open opens the file for appending. It must be called with f.mu held,
+// or before f is used.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size, f.opened = file, fi.Size(), time.Now()
+	return nil
+}
+
+// Write implements the io.Writer interface.
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && (f.MaxSize > 0 && f.size+int64(len(b)) > f.MaxSize ||
+		f.MaxAge > 0 && time.Since(f.opened) >= f.MaxAge) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file, opens a new one and removes the
+// old files beyond f.Keep. It must be called with f.mu held.
+func (f *rotatingFile) rotate() error {
+	f.f.Close()
+	f.f = nil
+	name := f.Name + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(f.Name, name); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.Keep <= 0 {
+		return nil
+	}
+	old, err := f.rotated()
+	if err != nil {
+		return err
+	}
+	for len(old) > f.Keep {
+		if err = os.Remove(old[0]); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// rotated returns the names of the rotated files, oldest first. They
+// are listed rather than globbed, as f.Name may contain metacharacters.
+func (f *rotatingFile) rotated() ([]string, error) {
+	dir, prefix := filepath.Split(f.Name)
+	fis, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), prefix+".") {
+			names = append(names, filepath.Join(dir, fi.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Close closes the file.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
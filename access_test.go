@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccess_Formats(t *testing.T) {
+	e := &accessEntry{
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		RemoteIP:  "192.0.2.1",
+		Proto:     "HTTP/1.1",
+		Method:    "GET",
+		Path:      "/tables",
+		Status:    206,
+		Bytes:     42,
+		Duration:  1.5,
+		UserAgent: "curl/7.0",
+		RequestID: "abc",
+		Upstreams: 3,
+		Failed:    1,
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{accessFormatGlog, `2020-01-02T03:04:05Z HTTP/1.1 206 "GET" "/tables" 192.0.2.1 42b 1.5ms abc - "curl/7.0" "" 3 1`},
+		{accessFormatCombined, `192.0.2.1 - - [02/Jan/2020:03:04:05 +0000] "GET /tables HTTP/1.1" 206 42 "-" "curl/7.0" abc 3 1`},
+	}
+	for _, tc := range tests {
+		var b bytes.Buffer
+		l := &AccessLog{Format: tc.format, Out: &b}
+		l.log(e)
+		if have := b.String(); have != tc.want+"\n" {
+			t.Fatalf("Unexpected %s line. Want:\n%s\nHave:\n%s", tc.format, tc.want, have)
+		}
+	}
+	var b bytes.Buffer
+	l := &AccessLog{Format: accessFormatJSON, Out: &b}
+	l.log(e)
+	var have accessEntry
+	if err := json.Unmarshal(b.Bytes(), &have); err != nil {
+		t.Fatal(err)
+	}
+	if have != *e {
+		t.Fatalf("Unexpected JSON entry. Want %+v, have %+v", e, have)
+	}
+	if _, err := parseAccessFormat("xml"); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
+
+func TestAccess_Fanout(t *testing.T) {
+	srv := new(Server)
+	mux := http.NewServeMux()
+	mux.Handle("/tables", fakeTables(0))
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.setUpstream(u.Host, nil)
+	srv.setUpstream("127.0.0.1:1", nil)
+	var b bytes.Buffer
+	l := &AccessLog{Format: accessFormatJSON, Out: &b}
+	s := httptest.NewServer(traceHandler(httpLog(NewHandler(srv), l)))
+	defer s.Close()
+	req, err := http.NewRequest("GET", s.URL+"/tables", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "test")
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("X-Request-ID", "abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var e accessEntry
+	if err = json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != http.StatusPartialContent || e.Upstreams != 2 || e.Failed != 1 ||
+		e.UserAgent != "test" || e.Referer != "http://example.com/" ||
+		e.RequestID != "abc" || len(e.TraceID) != 32 {
+		t.Fatalf("Unexpected access log entry: %+v", e)
+	}
+}
+
+func TestAccess_Escaping(t *testing.T) {
+	var b bytes.Buffer
+	l := &AccessLog{Format: accessFormatCombined, Out: &b}
+	s := httptest.NewServer(httpLog(http.NotFoundHandler(), l))
+	defer s.Close()
+	forged := "/tables%0a192.0.2.1%20-%20-%20%22GET%20/admin"
+	resp, err := http.Get(s.URL + forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"GET `+forged+` HTTP/1.1" 404`) {
+		t.Fatalf("Unexpected access log: %q", b.String())
+	}
+	e := &accessEntry{Method: "GET", Path: "/a\"b\nc", Proto: "HTTP/1.1"}
+	if have := combinedLine(e); !strings.Contains(have, `"GET /a\"b\nc HTTP/1.1"`) {
+		t.Fatalf("Unexpected combined line: %s", have)
+	}
+}
+
+func TestAccess_RotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Glob metacharacters in the name don't break pruning.
+	name := filepath.Join(dir, "access[1].log")
+	f := &rotatingFile{Name: name, MaxSize: 10, Keep: 2}
+	defer f.Close()
+	for i := 0; i < 4; i++ {
+		if _, err = f.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated files are named after the time, to the millisecond.
+		time.Sleep(2 * time.Millisecond)
+	}
+	old, err := f.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 2 {
+		t.Fatalf("Unexpected rotated files: %v", old)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "12345678\n" {
+		t.Fatalf("Unexpected content: %q", b)
+	}
+
+	f = &rotatingFile{Name: filepath.Join(dir, "aged.log"), MaxAge: time.Millisecond}
+	defer f.Close()
+	f.Write([]byte("one\n"))
+	time.Sleep(2 * time.Millisecond)
+	f.Write([]byte("two\n"))
+	old, err = f.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 1 {
+		t.Fatalf("Unexpected rotated files: %v", old)
+	}
+	if b, err = ioutil.ReadFile(old[0]); err != nil || !strings.HasPrefix(string(b), "one") {
+		t.Fatalf("Unexpected rotated content: %q, %v", b, err)
+	}
+}
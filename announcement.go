@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Announcement is the metadata a server multicasts to announce itself.
+//
+// On the wire an announcement is a magic header followed by the
+// protocol version and a list of TLV (type, length, value) fields:
+//
+//	+--------+---------+------+--------+-------+------+--------+-------+-----
+//	| "SVPE" | version | type | length | value | type | length | value | ...
+//	+--------+---------+------+--------+-------+------+--------+-------+-----
+//	  4 bytes  1 byte   1 byte 2 bytes   ...
+//
+// Length is a big-endian uint16. Fields of unknown type are skipped,
+// so new fields can be added without bumping the protocol version.
+//
+// Signed announcements carry a timestamp, a random nonce and an
+// HMAC-SHA256 of the packet, which must be the last field. See Sign.
+//
+// The legacy format, still sent by older policy engines, is a single
+// big-endian uint16 holding the port number.
+type Announcement struct {
+	Version   uint8             // Protocol version, 0 for legacy.
+	Port      uint16            // Port the http server listens on.
+	NodeID    string            // Unique identifier of the node.
+	Scheme    string            // URL scheme of the http server.
+	BasePath  string            // URL path prefix of the http server.
+	Labels    map[string]string // Free-form labels.
+	Goodbye   bool              // Whether the server is shutting down.
+	Timestamp time.Time         // Time the packet was signed.
+	Nonce     []byte            // Random nonce of signed packets.
+
+	// Source is the address the announcement was received from.
+	// It is set by Discover, and is not part of the packet.
+	Source string
+
+	// Verified is whether the signature of the announcement was
+	// verified with our key. It is set by Discover, and is not part
+	// of the packet.
+	Verified bool
+}
+
+const (
+	announcementMagic   = "SVPE"
+	announcementVersion = 1
+	legacyPacketSize    = 2
+)
+
+// TLV field types.
+const (
+	fieldPort     = 1 // uint16
+	fieldNodeID   = 2 // string
+	fieldScheme   = 3 // string
+	fieldBasePath = 4 // string
+	fieldLabel    = 5 // key=value string, may be repeated.
+	fieldTime     = 6 // int64 unix time in nanoseconds.
+	fieldNonce    = 7 // Random bytes.
+	fieldMAC      = 8 // HMAC-SHA256 of the preceding bytes.
+	fieldGoodbye  = 9 // Empty, present if the server is shutting down.
+)
+
+const (
+	nonceSize = 16
+	macSize   = sha256.Size
+)
+
+var (
+	errMalformedPacket    = errors.New("malformed announcement packet")
+	errUnsupportedVersion = errors.New("unsupported announcement version")
+	errMissingPort        = errors.New("announcement without port")
+	errPacketTooLarge     = errors.New("announcement packet too large")
+	errUnsigned           = errors.New("unsigned announcement")
+	errForged             = errors.New("forged announcement")
+	errReplayed           = errors.New("replayed announcement")
+)
+
+// sameAs returns whether a and b announce the same thing, that is,
+// whether they only differ in the fields that change with every packet:
+// Timestamp, Nonce and Source. Either can be nil.
+func (a *Announcement) sameAs(b *Announcement) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Version != b.Version || a.Port != b.Port || a.NodeID != b.NodeID ||
+		a.Scheme != b.Scheme || a.BasePath != b.BasePath ||
+		a.Goodbye != b.Goodbye || a.Verified != b.Verified ||
+		len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for k, v := range a.Labels {
+		if w, ok := b.Labels[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+// It always encodes the announcement in the current protocol version.
+func (a *Announcement) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(announcementMagic)
+	b.WriteByte(announcementVersion)
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, a.Port)
+	writeField(&b, fieldPort, port)
+	if len(a.NodeID) > 0 {
+		writeField(&b, fieldNodeID, []byte(a.NodeID))
+	}
+	if len(a.Scheme) > 0 {
+		writeField(&b, fieldScheme, []byte(a.Scheme))
+	}
+	if len(a.BasePath) > 0 {
+		writeField(&b, fieldBasePath, []byte(a.BasePath))
+	}
+	if a.Goodbye {
+		writeField(&b, fieldGoodbye, nil)
+	}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeField(&b, fieldLabel, []byte(k+"="+a.Labels[k]))
+	}
+	if b.Len() > maxDatagramSize {
+		return nil, errPacketTooLarge
+	}
+	return b.Bytes(), nil
+}
+
+// Sign encodes the announcement like MarshalBinary, then appends the
+// current time, a random nonce, and an HMAC of the packet using the
+// given key. The Timestamp and Nonce of the announcement are ignored.
+func (a *Announcement) Sign(key []byte) ([]byte, error) {
+	p, err := a.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.NewBuffer(p)
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	writeField(b, fieldTime, ts)
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	writeField(b, fieldNonce, nonce)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b.Bytes())
+	writeField(b, fieldMAC, mac.Sum(nil))
+	if b.Len() > maxDatagramSize {
+		return nil, errPacketTooLarge
+	}
+	return b.Bytes(), nil
+}
+
+// verifyPacket checks that the packet b, as created by Sign, was signed
+// with the given key. It returns errUnsigned if b is a legacy packet or
+// does not end with an HMAC, and errForged if the HMAC doesn't match.
+func verifyPacket(b, key []byte) error {
+	n := len(b) - 3 - macSize
+	if len(b) == legacyPacketSize || n < 0 ||
+		b[n] != fieldMAC ||
+		binary.BigEndian.Uint16(b[n+1:n+3]) != macSize {
+		return errUnsigned
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:n])
+	if !hmac.Equal(mac.Sum(nil), b[n+3:]) {
+		return errForged
+	}
+	return nil
+}
+
+// writeField writes a single TLV field to b.
+func writeField(b *bytes.Buffer, typ uint8, value []byte) {
+	b.WriteByte(typ)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.Write(value)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+// It accepts both the legacy and the current protocol versions.
+func (a *Announcement) UnmarshalBinary(b []byte) error {
+	*a = Announcement{}
+	if len(b) == legacyPacketSize {
+		a.Port = binary.BigEndian.Uint16(b)
+		return nil
+	}
+	n := len(announcementMagic)
+	if len(b) < n+1 || string(b[:n]) != announcementMagic {
+		return errMalformedPacket
+	}
+	if b[n] != announcementVersion {
+		return errUnsupportedVersion
+	}
+	a.Version = b[n]
+	hasPort := false
+	for b = b[n+1:]; len(b) > 0; {
+		if len(b) < 3 {
+			return errMalformedPacket
+		}
+		typ := b[0]
+		size := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+size {
+			return errMalformedPacket
+		}
+		value := b[3 : 3+size]
+		b = b[3+size:]
+		switch typ {
+		case fieldPort:
+			if size != 2 {
+				return errMalformedPacket
+			}
+			a.Port = binary.BigEndian.Uint16(value)
+			hasPort = true
+		case fieldNodeID:
+			a.NodeID = string(value)
+		case fieldScheme:
+			a.Scheme = string(value)
+		case fieldBasePath:
+			a.BasePath = string(value)
+		case fieldTime:
+			if size != 8 {
+				return errMalformedPacket
+			}
+			ns := int64(binary.BigEndian.Uint64(value))
+			a.Timestamp = time.Unix(0, ns)
+		case fieldNonce:
+			a.Nonce = append([]byte(nil), value...)
+		case fieldGoodbye:
+			a.Goodbye = true
+		case fieldLabel:
+			kv := strings.SplitN(string(value), "=", 2)
+			if len(kv) != 2 {
+				return errMalformedPacket
+			}
+			if a.Labels == nil {
+				a.Labels = make(map[string]string)
+			}
+			a.Labels[kv[0]] = kv[1]
+		}
+	}
+	if !hasPort {
+		return errMissingPort
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestAnnouncement_RoundTrip(t *testing.T) {
+	want := &Announcement{
+		Version:  announcementVersion,
+		Port:     1111,
+		NodeID:   "pts-1",
+		Scheme:   "https",
+		BasePath: "/api",
+		Labels:   map[string]string{"site": "a", "rack": "2"},
+		Goodbye:  true,
+	}
+	b, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := new(Announcement)
+	if err = have.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Fatalf("Unexpected announcement. Want %+v, have %+v", want, have)
+	}
+}
+
+func TestAnnouncement_Legacy(t *testing.T) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, 1111)
+	var a Announcement
+	if err := a.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 0 || a.Port != 1111 {
+		t.Fatalf("Unexpected announcement: %+v", a)
+	}
+}
+
+func TestAnnouncement_UnknownField(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString(announcementMagic)
+	b.WriteByte(announcementVersion)
+	writeField(&b, 200, []byte("from the future"))
+	writeField(&b, fieldPort, []byte{0x04, 0x57})
+	var a Announcement
+	if err := a.UnmarshalBinary(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 1111 {
+		t.Fatalf("Unexpected port. Want 1111, have %d", a.Port)
+	}
+}
+
+func TestAnnouncement_Malformed(t *testing.T) {
+	header := announcementMagic + string([]byte{announcementVersion})
+	tests := []struct {
+		packet string
+		err    error
+	}{
+		{"", errMalformedPacket},
+		{"x", errMalformedPacket},
+		{"XXXX\x01\x01\x00\x02\x04\x57", errMalformedPacket},
+		{announcementMagic + "\x09", errUnsupportedVersion},
+		{header, errMissingPort},
+		{header + "\x01\x00\x02\x04", errMalformedPacket},
+		{header + "\x01\x00\x03\x04\x57\x00", errMalformedPacket},
+		{header + "\x01\x00\x02\x04\x57\x05\x00\x01x", errMalformedPacket},
+	}
+	for _, tc := range tests {
+		var a Announcement
+		if err := a.UnmarshalBinary([]byte(tc.packet)); err != tc.err {
+			t.Fatalf("Unexpected error for %q. Want %v, have %v",
+				tc.packet, tc.err, err)
+		}
+	}
+}
+
+func TestAnnouncement_TooLarge(t *testing.T) {
+	a := &Announcement{
+		Port:   1111,
+		NodeID: string(make([]byte, maxDatagramSize)),
+	}
+	if _, err := a.MarshalBinary(); err != errPacketTooLarge {
+		t.Fatalf("Expected error didn't occur. Got: %v", err)
+	}
+}
+
+func TestAnnouncement_Sign(t *testing.T) {
+	key := []byte("secret")
+	a := &Announcement{Port: 1111, NodeID: "pts-1"}
+	b, err := a.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyPacket(b, key); err != nil {
+		t.Fatal(err)
+	}
+	var have Announcement
+	if err = have.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if have.Timestamp.IsZero() || len(have.Nonce) != nonceSize {
+		t.Fatalf("Missing timestamp or nonce: %+v", have)
+	}
+	if err = verifyPacket(b, []byte("other")); err != errForged {
+		t.Fatalf("Unexpected error for wrong key: %v", err)
+	}
+	b[len(announcementMagic)+4]++ // Change the port.
+	if err = verifyPacket(b, key); err != errForged {
+		t.Fatalf("Unexpected error for tampered packet: %v", err)
+	}
+}
+
+func TestAnnouncement_VerifyUnsigned(t *testing.T) {
+	b, err := (&Announcement{Port: 1111}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][]byte{b, {0x04, 0x57}} {
+		if err = verifyPacket(p, []byte("secret")); err != errUnsigned {
+			t.Fatalf("Unexpected error for %q: %v", p, err)
+		}
+	}
+}
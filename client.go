@@ -1,22 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+// upstreamURL returns the URL of the given path in the upstream server
+// at addr, in form of ip:port, with the given scheme. The zone of IPv6
+// link-local addresses is escaped as per RFC 6874.
+func upstreamURL(scheme, addr, path string) string {
+	return scheme + "://" + strings.Replace(addr, "%", "%25", 1) + path
+}
+
 // getTables queries a remote web server and return a list of tables
-// available in the policy engine of that server.
-func getTables(url string) (map[string][]string, error) {
+// available in the policy engine of that server. The request is
+// cancelled when ctx is done.
+func getTables(ctx context.Context, c *http.Client, url string) (map[string][]string, error) {
 	glog.V(2).Infof("making request to upstream server %s", url)
-	resp, err := http.Get(url)
+	resp, err := get(ctx, c, url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer drain(resp)
 	if resp.StatusCode != http.StatusOK {
 		return nil, errUnexpectedStatus
 	}
@@ -34,7 +50,137 @@ func getTables(url string) (map[string][]string, error) {
 	return m, nil
 }
 
+// getTableRows queries a remote web server and return the rows of the
+// given table in the policy engine of that server. It returns
+// errTableNotFound if the policy engine does not have such table.
+func getTableRows(ctx context.Context, c *http.Client, url string) (map[string]interface{}, error) {
+	glog.V(2).Infof("making request to upstream server %s", url)
+	resp, err := get(ctx, c, url)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errTableNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errUnexpectedStatus
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		return nil, errUnexpectedContentType
+	}
+	var m map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		return nil, errUnexpectedResponse
+	}
+	return m, nil
+}
+
+// setTableRows sends a request with the given method and body to a
+// remote web server to change the rows of a table in the policy
+// engine of that server. It returns the status code of the response,
+// which is zero if the request could not be made at all.
+func setTableRows(ctx context.Context, c *http.Client, method, url, contentType string, body []byte) (int, error) {
+	glog.V(2).Infof("making %s request to upstream server %s", method, url)
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	drain(resp)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return resp.StatusCode, errTableNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return resp.StatusCode, errUnexpectedStatus
+	}
+	return resp.StatusCode, nil
+}
+
+// get makes a GET request to url with the client c, that is cancelled
+// when ctx is done.
+func get(ctx context.Context, c *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// drain reads the rest of the body of resp and closes it, so that its
+// connection can be reused.
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// probeHealth makes a request with the client c to a remote web server
+// to check whether it is healthy, that is, it responds with a 2xx status
+// code within the given timeout.
+func probeHealth(c *http.Client, url string, timeout time.Duration) error {
+	glog.V(3).Infof("probing upstream server %s", url)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := get(ctx, c, url)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errUnexpectedStatus
+	}
+	return nil
+}
+
+// Classes of errors of requests to upstream servers.
+const (
+	classCircuitOpen = "circuit_open" // Not attempted, see health.
+	classTimeout     = "timeout"      // No response in time.
+	classConnection  = "connection"   // Could not connect or send the request.
+	classCanceled    = "canceled"     // The client went away.
+	classStatus      = "status"       // Unexpected status code.
+	classContentType = "content_type" // Unexpected Content-Type.
+	classResponse    = "response"     // Response body not valid JSON.
+	classDocument    = "document"     // JSON document of the wrong shape.
+	classOther       = "other"
+)
+
+// errorClass returns the class of an error returned by the functions
+// that make requests to upstream servers.
+func errorClass(err error) string {
+	switch err {
+	case errCircuitOpen:
+		return classCircuitOpen
+	case errUnexpectedStatus:
+		return classStatus
+	case errUnexpectedContentType:
+		return classContentType
+	case errUnexpectedResponse:
+		return classResponse
+	case errUnexpectedDocument:
+		return classDocument
+	}
+	if errors.Is(err, context.Canceled) {
+		return classCanceled
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return classTimeout
+	}
+	if _, ok := err.(*url.Error); ok {
+		return classConnection
+	}
+	return classOther
+}
+
 var (
+	errTableNotFound         = errors.New("table not found")
 	errUnexpectedStatus      = errors.New("unexpected status code")
 	errUnexpectedContentType = errors.New("unexpected content type")
 	errUnexpectedResponse    = errors.New("unexpected server response")
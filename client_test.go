@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
+var ctx = context.Background()
+
 func TestClient_GetTables(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -17,7 +23,7 @@ func TestClient_GetTables(t *testing.T) {
 	})
 	s := httptest.NewServer(mux)
 	defer s.Close()
-	m, err := getTables(s.URL + "/")
+	m, err := getTables(ctx, http.DefaultClient, s.URL+"/")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,7 +43,7 @@ func TestClient_GetTables_UnexpectedStatus(t *testing.T) {
 	})
 	s := httptest.NewServer(mux)
 	defer s.Close()
-	m, err := getTables(s.URL + "/")
+	m, err := getTables(ctx, http.DefaultClient, s.URL+"/")
 	if err != errUnexpectedStatus {
 		t.Fatalf("Expected error didn't occur. Got: %#v, %s", m, err)
 	}
@@ -50,7 +56,7 @@ func TestClient_GetTables_UnexpectedContentType(t *testing.T) {
 	})
 	s := httptest.NewServer(mux)
 	defer s.Close()
-	m, err := getTables(s.URL + "/")
+	m, err := getTables(ctx, http.DefaultClient, s.URL+"/")
 	if err != errUnexpectedContentType {
 		t.Fatalf("Expected error didn't occur. Got: %#v, %s", m, err)
 	}
@@ -64,7 +70,7 @@ func TestClient_GetTables_UnexpectedResponse(t *testing.T) {
 	})
 	s := httptest.NewServer(mux)
 	defer s.Close()
-	m, err := getTables(s.URL + "/")
+	m, err := getTables(ctx, http.DefaultClient, s.URL+"/")
 	if err != errUnexpectedResponse {
 		t.Fatalf("Expected error didn't occur. Got: %#v, %s", m, err)
 	}
@@ -80,8 +86,122 @@ func TestClient_GetTables_UnexpectedDocument(t *testing.T) {
 	})
 	s := httptest.NewServer(mux)
 	defer s.Close()
-	m, err := getTables(s.URL + "/")
+	m, err := getTables(ctx, http.DefaultClient, s.URL+"/")
 	if err != errUnexpectedDocument {
 		t.Fatalf("Expected error didn't occur. Got: %#v, %s", m, err)
 	}
 }
+
+func TestClient_GetTableRows(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{
+			"rows": {"a", "b"},
+		})
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	m, err := getTableRows(ctx, http.DefaultClient, s.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["rows"]; !ok {
+		t.Fatalf("Missing rows key: %#v", m)
+	}
+}
+
+func TestClient_GetTableRows_NotFound(t *testing.T) {
+	s := httptest.NewServer(http.NewServeMux())
+	defer s.Close()
+	m, err := getTableRows(ctx, http.DefaultClient, s.URL+"/")
+	if err != errTableNotFound {
+		t.Fatalf("Expected error didn't occur. Got: %#v, %s", m, err)
+	}
+}
+
+func TestClient_SetTableRows(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if v := r.Header.Get("Content-Type"); v != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	status, err := setTableRows(ctx, http.DefaultClient, "PUT", s.URL+"/", "application/json", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNoContent {
+		t.Fatalf("Unexpected status. Want 204, have %d", status)
+	}
+}
+
+func TestClient_SetTableRows_UnexpectedStatus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	status, err := setTableRows(ctx, http.DefaultClient, "POST", s.URL+"/", "", nil)
+	if err != errUnexpectedStatus {
+		t.Fatalf("Expected error didn't occur. Got: %d, %s", status, err)
+	}
+}
+
+func TestClient_UpstreamURL(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.1:1111", "http://10.0.0.1:1111/tables"},
+		{"[fd00::1]:1111", "http://[fd00::1]:1111/tables"},
+		{"[fe80::1%eth0]:1111", "http://[fe80::1%25eth0]:1111/tables"},
+	}
+	for _, tc := range tests {
+		have := upstreamURL("http", tc.addr, "/tables")
+		if have != tc.want {
+			t.Fatalf("Unexpected URL. Want %s, have %s", tc.want, have)
+		}
+		if _, err := url.Parse(have); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClient_ErrorClass(t *testing.T) {
+	closed := httptest.NewServer(http.NewServeMux())
+	closed.Close()
+	_, connErr := getTables(ctx, http.DefaultClient, closed.URL+"/tables")
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	timeoutErr := probeHealth(http.DefaultClient, slow.URL, 10*time.Millisecond)
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errCircuitOpen, classCircuitOpen},
+		{errUnexpectedStatus, classStatus},
+		{errUnexpectedContentType, classContentType},
+		{errUnexpectedResponse, classResponse},
+		{errUnexpectedDocument, classDocument},
+		{connErr, classConnection},
+		{timeoutErr, classTimeout},
+		{errors.New("boom"), classOther},
+	}
+	for _, tc := range tests {
+		if have := errorClass(tc.err); have != tc.want {
+			t.Fatalf("Unexpected class of %v. Want %s, have %s", tc.err, tc.want, have)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Credentials adds credentials to requests to upstream servers.
+type Credentials interface {
+	// Authorize sets the credentials of req, a request to the
+	// upstream server at addr, in form of ip:port.
+	Authorize(req *http.Request, addr string) error
+}
+
+// BearerToken is a Credentials that sends the same bearer token to
+// every upstream server.
+type BearerToken string
+
+// Authorize implements the Credentials interface.
+func (t BearerToken) Authorize(req *http.Request, addr string) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// BasicAuth is a Credentials that sends the same username and
+// password to every upstream server.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authorize implements the Credentials interface.
+func (a *BasicAuth) Authorize(req *http.Request, addr string) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// secret is the credentials of an upstream server in a secrets file.
+// Token is a bearer token, which takes precedence over Username and
+// Password for basic auth.
+type secret struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// SecretsFile is a Credentials that sends a different secret to each
+// upstream server. The secrets are read from a file, which is checked
+// for changes at most every Interval when requests are made, or on
+// every request if Interval is zero.
+//
+// The file is a JSON object mapping addresses of upstream servers to
+// their secret, an object with either a "token" to send as bearer
+// token or a "username" and "password" for basic auth. The "*" address
+// is the secret of upstream servers not listed. Requests to upstream
+// servers without a secret are sent as they are.
+//
+// Load returns an error if the file can't be read. Errors reloading
+// it are logged, and the secrets left unchanged.
+type SecretsFile struct {
+	Name     string
+	Interval time.Duration
+
+	mu      sync.Mutex         // Guards the below.
+	fi      os.FileInfo        // File last read.
+	checked time.Time          // Time the file was last checked.
+	secrets map[string]*secret // Secrets by address.
+}
+
+// Load reads the secrets file.
+func (f *SecretsFile) Load() error {
+	fi, err := os.Stat(f.Name)
+	if err != nil {
+		return err
+	}
+	secrets, err := readSecretsFile(f.Name)
+	if err != nil {
+		return err
+	}
+	glog.V(1).Infof("loaded %d upstream secrets from %s", len(secrets), f.Name)
+	f.mu.Lock()
+	f.fi, f.checked, f.secrets = fi, time.Now(), secrets
+	f.mu.Unlock()
+	return nil
+}
+
+// Authorize implements the Credentials interface.
+func (f *SecretsFile) Authorize(req *http.Request, addr string) error {
+	s := f.secret(addr)
+	switch {
+	case s == nil:
+	case len(s.Token) > 0:
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	default:
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	return nil
+}
+
+// secret returns the secret of the upstream server at addr, or nil if
+// it has none, reloading the file first if it changed.
+func (f *SecretsFile) secret(addr string) *secret {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= f.Interval {
+		f.checked = now
+		f.reload()
+	}
+	if s, ok := f.secrets[addr]; ok {
+		return s
+	}
+	return f.secrets["*"]
+}
+
+// reload reads the secrets file again if it changed since it was last
+// read. It must be called with f.mu held.
+func (f *SecretsFile) reload() {
+	fi, err := os.Stat(f.Name)
+	if err != nil {
+		glog.Errorf("secrets file: %v", err)
+		return
+	}
+	if f.fi != nil && fi.ModTime().Equal(f.fi.ModTime()) && fi.Size() == f.fi.Size() {
+		return
+	}
+	secrets, err := readSecretsFile(f.Name)
+	if err != nil {
+		glog.Errorf("secrets file: %v", err)
+		return
+	}
+	glog.V(1).Infof("reloaded %d upstream secrets from %s", len(secrets), f.Name)
+	f.fi, f.secrets = fi, secrets
+}
+
+// readSecretsFile reads the secrets of upstream servers from a file,
+// see SecretsFile for the format.
+func readSecretsFile(name string) (map[string]*secret, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var secrets map[string]*secret
+	if err = json.Unmarshal(b, &secrets); err != nil {
+		return nil, err
+	}
+	for addr, s := range secrets {
+		if s == nil || len(s.Token) == 0 && len(s.Username) == 0 {
+			return nil, fmt.Errorf("no token or username for %s", addr)
+		}
+	}
+	return secrets, nil
+}
+
+// ForwardPolicy is whether the Authorization header of callers is
+// forwarded to upstream servers.
+type ForwardPolicy string
+
+// Policies of forwarding the Authorization header of callers.
+const (
+	ForwardNever    ForwardPolicy = "never"    // Never forwarded.
+	ForwardAlways   ForwardPolicy = "always"   // Forwarded if present, instead of our credentials.
+	ForwardFallback ForwardPolicy = "fallback" // Forwarded if we have no credentials for the upstream.
+)
+
+// parseForwardPolicy parses the name of a ForwardPolicy.
+func parseForwardPolicy(s string) (ForwardPolicy, error) {
+	switch p := ForwardPolicy(s); p {
+	case ForwardNever, ForwardAlways, ForwardFallback:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid forward policy %q", s)
+}
+
+// authorize sets the credentials of req, a request to the upstream
+// server at addr, from s.Credentials and the Authorization header of
+// the incoming request that caused it, if any, as per s.ForwardAuth.
+//
+// No credentials are sent to servers that are not registered upstream
+// servers, nor over plain http unless s.InsecureCredentials is set.
+func (s *Server) authorize(req *http.Request, addr string) error {
+	if s.Credentials == nil && (s.ForwardAuth == "" || s.ForwardAuth == ForwardNever) {
+		return nil
+	}
+	if !s.hasUpstream(addr) {
+		glog.V(2).Infof("not sending credentials to unknown server %s", addr)
+		return nil
+	}
+	if req.URL.Scheme != "https" && !s.InsecureCredentials {
+		glog.V(2).Infof("not sending credentials over %s to %s", req.URL.Scheme, addr)
+		return nil
+	}
+	var caller string
+	if in := incomingRequest(req.Context()); in != nil {
+		caller = in.Header.Get("Authorization")
+	}
+	if len(caller) > 0 && s.ForwardAuth == ForwardAlways {
+		req.Header.Set("Authorization", caller)
+		return nil
+	}
+	if s.Credentials != nil {
+		if err := s.Credentials.Authorize(req, addr); err != nil {
+			return err
+		}
+	}
+	if len(caller) > 0 && s.ForwardAuth == ForwardFallback &&
+		len(req.Header.Get("Authorization")) == 0 {
+		req.Header.Set("Authorization", caller)
+	}
+	return nil
+}
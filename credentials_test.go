@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCredentials_Static(t *testing.T) {
+	tests := []struct {
+		creds Credentials
+		want  string
+	}{
+		{BearerToken("t0k3n"), "Bearer t0k3n"},
+		{&BasicAuth{Username: "user", Password: "pass"}, "Basic dXNlcjpwYXNz"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "http://127.0.0.1:1111/tables", nil)
+		if err := tc.creds.Authorize(req, "127.0.0.1:1111"); err != nil {
+			t.Fatal(err)
+		}
+		if have := req.Header.Get("Authorization"); have != tc.want {
+			t.Fatalf("Unexpected Authorization. Want %q, have %q", tc.want, have)
+		}
+	}
+}
+
+func TestCredentials_SecretsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "secrets")
+	err = ioutil.WriteFile(name, []byte(`{
+		"127.0.0.1:1111": {"token": "one"},
+		"127.0.0.1:2222": {"username": "user", "password": "pass"}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &SecretsFile{Name: name}
+	if err = f.Load(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(addr, want string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://"+addr+"/tables", nil)
+		if err := f.Authorize(req, addr); err != nil {
+			t.Fatal(err)
+		}
+		if have := req.Header.Get("Authorization"); have != want {
+			t.Fatalf("Unexpected Authorization of %s. Want %q, have %q",
+				addr, want, have)
+		}
+	}
+	check("127.0.0.1:1111", "Bearer one")
+	check("127.0.0.1:2222", "Basic dXNlcjpwYXNz")
+	check("127.0.0.1:3333", "")
+
+	err = ioutil.WriteFile(name, []byte(`{
+		"127.0.0.1:1111": {"token": "uno"},
+		"*": {"token": "default"}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is noticed on file systems with coarse
+	// modification times.
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(name, future, future); err != nil {
+		t.Fatal(err)
+	}
+	check("127.0.0.1:1111", "Bearer uno")
+	check("127.0.0.1:2222", "Bearer default")
+
+	// Broken files are ignored.
+	if err = ioutil.WriteFile(name, []byte(`{"127.0.0.1:1111": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	check("127.0.0.1:1111", "Bearer uno")
+	if err = (&SecretsFile{Name: name}).Load(); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
+
+func TestCredentials_Forward(t *testing.T) {
+	auth := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tables", func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		fakeTables(0)(w, r)
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		creds  Credentials
+		policy ForwardPolicy
+		caller string
+		want   string
+	}{
+		{nil, "", "Bearer caller", ""},
+		{BearerToken("ours"), ForwardNever, "Bearer caller", "Bearer ours"},
+		{BearerToken("ours"), ForwardAlways, "Bearer caller", "Bearer caller"},
+		{BearerToken("ours"), ForwardAlways, "", "Bearer ours"},
+		{BearerToken("ours"), ForwardFallback, "Bearer caller", "Bearer ours"},
+		{nil, ForwardFallback, "Bearer caller", "Bearer caller"},
+	}
+	for _, tc := range tests {
+		srv := &Server{
+			Credentials:         tc.creds,
+			ForwardAuth:         tc.policy,
+			InsecureCredentials: true,
+		}
+		srv.setUpstream(u.Host, nil)
+		s := httptest.NewServer(NewHandler(srv))
+		req, err := http.NewRequest("GET", s.URL+"/tables", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tc.caller) > 0 {
+			req.Header.Set("Authorization", tc.caller)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		s.Close()
+		if have := <-auth; have != tc.want {
+			t.Fatalf("Unexpected Authorization with policy %q and caller %q. Want %q, have %q",
+				tc.policy, tc.caller, tc.want, have)
+		}
+	}
+}
+
+func TestCredentials_Restricted(t *testing.T) {
+	auth := make(chan string, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tables", func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		fakeTables(0)(w, r)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		http.Redirect(w, r, "/tables", http.StatusFound)
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(srv *Server, path string) string {
+		t.Helper()
+		req, err := http.NewRequest("GET", upstream.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.httpClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return <-auth
+	}
+
+	// Not a registered upstream server.
+	srv := &Server{Credentials: BearerToken("ours"), InsecureCredentials: true}
+	if have := get(srv, "/tables"); have != "" {
+		t.Fatalf("Unexpected Authorization to unknown server: %q", have)
+	}
+
+	// Plain http, without InsecureCredentials.
+	srv = &Server{Credentials: BearerToken("ours")}
+	srv.setUpstream(u.Host, nil)
+	if have := get(srv, "/tables"); have != "" {
+		t.Fatalf("Unexpected Authorization over http: %q", have)
+	}
+
+	// Redirects are not followed.
+	srv.InsecureCredentials = true
+	if have := get(srv, "/redirect"); have != "Bearer ours" {
+		t.Fatalf("Unexpected Authorization: %q", have)
+	}
+	select {
+	case have := <-auth:
+		t.Fatalf("Redirect followed with Authorization %q", have)
+	default:
+	}
+}
+
+func TestCredentials_ParseForwardPolicy(t *testing.T) {
+	for _, v := range []string{"never", "always", "fallback"} {
+		if p, err := parseForwardPolicy(v); err != nil || string(p) != v {
+			t.Fatalf("Unexpected policy %q: %v", p, err)
+		}
+	}
+	if _, err := parseForwardPolicy("sometimes"); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Discoverer is a source of upstream servers.
+type Discoverer interface {
+	// Discover sends events about upstream servers to the events
+	// channel until ctx is done, when it returns nil, or until an
+	// error occurs.
+	Discover(ctx context.Context, events chan<- DiscoveryEvent) error
+}
+
+// DiscoveryEventType is the type of a DiscoveryEvent.
+type DiscoveryEventType int
+
+const (
+	DiscoveryAdd    DiscoveryEventType = iota // Upstream server found.
+	DiscoveryRemove                           // Upstream server gone.
+)
+
+// DiscoveryEvent is sent by a Discoverer when it finds an upstream
+// server, or notices that an upstream server is gone.
+type DiscoveryEvent struct {
+	Type         DiscoveryEventType
+	Addr         string        // Address in form of ip:port.
+	Origin       string        // Kind of discoverer, e.g. multicast.
+	Announcement *Announcement // Multicast announcement, if any.
+}
+
+// sendEvent sends ev to events, unless ctx is done first.
+func sendEvent(ctx context.Context, events chan<- DiscoveryEvent, ev DiscoveryEvent) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// RunDiscoverers runs the given discoverers concurrently, and merges
+// their events into the internal list of upstream servers. If one of
+// them fails the others are stopped, and its error is returned.
+//
+// Upstream servers are recorded with the origins of all discoverers
+// that find them, and removed only when the discoverers of all those
+// origins say they are gone. Pinned upstream servers are never
+// removed.
+//
+// It is supposed to run on its own goroutine, and returns nil after
+// Shutdown.
+func (s *Server) RunDiscoverers(ds ...Discoverer) error {
+	if len(ds) == 0 {
+		// Upstream servers can still be registered via the admin
+		// API, so the server can be ready without discoverers.
+		atomic.StoreInt32(&s.noDiscoverers, 1)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel()
+	atomic.AddInt32(&s.discovering, 1)
+	defer atomic.AddInt32(&s.discovering, -1)
+	events := make(chan DiscoveryEvent)
+	errc := make(chan error, len(ds))
+	for _, d := range ds {
+		go func(d Discoverer) { errc <- d.Discover(ctx, events) }(d)
+	}
+	var err error
+	for n := len(ds); n > 0; {
+		select {
+		case ev := <-events:
+			s.applyDiscoveryEvent(ev)
+		case e := <-errc:
+			n--
+			if e != nil && err == nil {
+				err = e
+				cancel()
+			}
+		}
+	}
+	return err
+}
+
+// applyDiscoveryEvent updates the internal list of upstream servers
+// with the given event.
+func (s *Server) applyDiscoveryEvent(ev DiscoveryEvent) {
+	switch ev.Type {
+	case DiscoveryAdd:
+		if ev.Origin == originMulticast {
+			s.setUpstream(ev.Addr, ev.Announcement)
+		} else {
+			s.registerUpstream(ev.Addr, ev.Origin, nil, nil)
+		}
+	case DiscoveryRemove:
+		s.delDiscoveredUpstream(ev.Addr, ev.Origin)
+	}
+}
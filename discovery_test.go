@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscovery_MergeAndFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "upstreams")
+	err = ioutil.WriteFile(name, []byte("127.0.0.1:1111\n127.0.0.1:2222\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	static := StaticDiscoverer{"127.0.0.1:2222", "127.0.0.1:3333"}
+	file := &FileDiscoverer{Name: name, Interval: 10 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- s.RunDiscoverers(static, file) }()
+	want := []string{"127.0.0.1:1111", "127.0.0.1:2222", "127.0.0.1:3333"}
+	waitUpstreams(t, s, want)
+	if u := s.getUpstream("127.0.0.1:1111"); u.Origin != originFile {
+		t.Fatalf("Unexpected origin. Want file, have %s", u.Origin)
+	}
+	// Upstreams removed from the file are only deleted if no other
+	// origin vouches for them, 2222 is also listed by the static
+	// discoverer.
+	err = ioutil.WriteFile(name, []byte(`["127.0.0.1:4444"]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"127.0.0.1:2222", "127.0.0.1:3333", "127.0.0.1:4444"}
+	waitUpstreams(t, s, want)
+	for i := 0; ; i++ {
+		u := s.getUpstream("127.0.0.1:2222")
+		if reflect.DeepEqual(u.Origins, []string{originStatic}) {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Unexpected origins. Want [static], have %v", u.Origins)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingDiscoverer is a Discoverer that fails right away.
+type failingDiscoverer struct{}
+
+func (failingDiscoverer) Discover(ctx context.Context, events chan<- DiscoveryEvent) error {
+	return errors.New("failed")
+}
+
+func TestDiscovery_Origins(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := &Server{LeaseInterval: time.Second, LeaseMisses: 1, now: clock.Now}
+	check := func(addr string, want ...string) {
+		t.Helper()
+		u := s.getUpstream(addr)
+		if len(want) == 0 {
+			if u != nil {
+				t.Fatalf("Unexpected upstream %s: %+v", addr, u)
+			}
+			return
+		}
+		if u == nil || !reflect.DeepEqual(u.Origins, want) || u.Origin != want[0] {
+			t.Fatalf("Unexpected upstream %s. Want origins %v, have %+v", addr, want, u)
+		}
+	}
+
+	// Announced via multicast first, then listed in the file.
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryAdd, Addr: "a", Origin: originMulticast})
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryAdd, Addr: "a", Origin: originFile})
+	check("a", originMulticast, originFile)
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryRemove, Addr: "a", Origin: originMulticast})
+	check("a", originFile)
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryAdd, Addr: "a", Origin: originMulticast})
+	clock.Add(2 * time.Second)
+	if expired := s.expireUpstreams(); len(expired) != 0 {
+		t.Fatalf("Unexpected expired upstreams: %v", expired)
+	}
+	check("a", originFile)
+
+	// Listed in the file first, then announced via multicast.
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryAdd, Addr: "b", Origin: originFile})
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryAdd, Addr: "b", Origin: originMulticast})
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryRemove, Addr: "b", Origin: originFile})
+	check("b", originMulticast)
+	clock.Add(2 * time.Second)
+	if expired := s.expireUpstreams(); len(expired) != 1 || expired[0] != "b" {
+		t.Fatalf("Unexpected expired upstreams. Want [b], have %v", expired)
+	}
+	check("b")
+	s.applyDiscoveryEvent(DiscoveryEvent{Type: DiscoveryRemove, Addr: "a", Origin: originFile})
+	check("a")
+}
+
+func TestDiscovery_Error(t *testing.T) {
+	s := &Server{}
+	err := s.RunDiscoverers(StaticDiscoverer{"127.0.0.1:1111"}, failingDiscoverer{})
+	if err == nil || err.Error() != "failed" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDiscovery_None(t *testing.T) {
+	s := &Server{}
+	if err := s.RunDiscoverers(); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.readiness(); !r.Discovering {
+		t.Fatalf("Unexpected readiness without discoverers: %+v", r)
+	}
+}
+
+// waitUpstreams waits up to a second for the upstreams of s to be want.
+func waitUpstreams(t *testing.T, s *Server, want []string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		have := s.upstreamList()
+		if reflect.DeepEqual(want, have) {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("Unexpected upstreams. Want %v, have %v", want, have)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
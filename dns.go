@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DNSDiscoverer is a Discoverer of the upstream servers published in
+// DNS, which is queried every Interval.
+//
+// If Port is zero, Name is looked up as an SRV record such as
+// _policy._tcp.example.com, and the addresses of each target are used
+// with the port of the record. Otherwise Name is looked up as A and
+// AAAA records, and their addresses are used with Port.
+//
+// Upstream servers that are no longer published are reported as gone.
+// Lookup errors are logged, and the upstream servers left unchanged.
+// Discover returns an error if Interval is not positive.
+type DNSDiscoverer struct {
+	Name     string
+	Port     int
+	Interval time.Duration
+	Resolver *net.Resolver // Defaults to net.DefaultResolver.
+}
+
+// Discover implements the Discoverer interface.
+func (d *DNSDiscoverer) Discover(ctx context.Context, events chan<- DiscoveryEvent) error {
+	if d.Interval <= 0 {
+		return fmt.Errorf("invalid upstreams DNS interval %s", d.Interval)
+	}
+	var addrs []string
+	t := time.NewTicker(d.Interval)
+	defer t.Stop()
+	for {
+		next, err := d.lookup(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			glog.Errorf("dns discovery of %s: %v", d.Name, err)
+		} else {
+			if !syncEvents(ctx, events, originDNS, addrs, next) {
+				return nil
+			}
+			addrs = next
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// lookup returns the sorted list of upstream servers published in DNS.
+func (d *DNSDiscoverer) lookup(ctx context.Context) ([]string, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	var addrs []string
+	if d.Port != 0 {
+		ips, err := r.LookupHost(ctx, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(d.Port)))
+		}
+	} else {
+		_, srvs, err := r.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			ips, err := r.LookupHost(ctx, target)
+			if err != nil {
+				return nil, err
+			}
+			port := strconv.Itoa(int(srv.Port))
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip, port))
+			}
+		}
+	}
+	sort.Strings(addrs)
+	glog.V(2).Infof("dns discovery of %s: %v", d.Name, addrs)
+	return addrs, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Types of DNS records supported by stubDNS.
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+// stubDNS is a minimal DNS server for tests, which answers A and SRV
+// queries from a fixed set of records.
+type stubDNS struct {
+	conn net.PacketConn
+
+	mu  sync.Mutex
+	a   map[string][]net.IP
+	srv map[string][]*net.SRV
+}
+
+func newStubDNS(t *testing.T) *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &stubDNS{
+		conn: conn,
+		a:    make(map[string][]net.IP),
+		srv:  make(map[string][]*net.SRV),
+	}
+	go d.serve()
+	return d
+}
+
+// Resolver returns a resolver that sends all queries to d.
+func (d *stubDNS) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", d.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (d *stubDNS) Close() { d.conn.Close() }
+
+func (d *stubDNS) setA(name string, ips ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.a[name] = nil
+	for _, ip := range ips {
+		d.a[name] = append(d.a[name], net.ParseIP(ip).To4())
+	}
+}
+
+func (d *stubDNS) setSRV(name string, srvs ...*net.SRV) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.srv[name] = srvs
+}
+
+func (d *stubDNS) serve() {
+	b := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if resp := d.answer(b[:n]); resp != nil {
+			d.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer returns the response to the query q.
+func (d *stubDNS) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	// Parse the question.
+	var labels []string
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		n := int(q[i])
+		if i+1+n > len(q) {
+			return nil
+		}
+		labels = append(labels, string(q[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+5 > len(q) {
+		return nil
+	}
+	question := q[12 : i+5]
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(q[i+1 : i+3])
+	var answers [][]byte
+	d.mu.Lock()
+	switch qtype {
+	case dnsTypeA:
+		for _, ip := range d.a[name] {
+			answers = append(answers, dnsRecord(dnsTypeA, ip))
+		}
+	case dnsTypeSRV:
+		for _, srv := range d.srv[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[0:], srv.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], srv.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], srv.Port)
+			rdata = append(rdata, dnsName(srv.Target)...)
+			answers = append(answers, dnsRecord(dnsTypeSRV, rdata))
+		}
+	}
+	d.mu.Unlock()
+	resp := make([]byte, 12)
+	copy(resp, q[:2])                            // ID.
+	binary.BigEndian.PutUint16(resp[2:], 0x8180) // Response, recursion.
+	binary.BigEndian.PutUint16(resp[4:], 1)      // Questions.
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
+
+// dnsRecord returns a resource record for the name in the question.
+func dnsRecord(typ uint16, rdata []byte) []byte {
+	b := []byte{0xc0, 12}                        // Name in the question.
+	b = append(b, byte(typ>>8), byte(typ), 0, 1) // Type, class IN.
+	b = append(b, 0, 0, 0, 60)                   // TTL.
+	b = append(b, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(b, rdata...)
+}
+
+// dnsName returns name in DNS wire format.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// collectEvents runs d and returns the first n events it sends.
+func collectEvents(t *testing.T, d Discoverer, n int) []DiscoveryEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan DiscoveryEvent)
+	errc := make(chan error, 1)
+	go func() { errc <- d.Discover(ctx, events) }()
+	var evs []DiscoveryEvent
+	for len(evs) < n {
+		select {
+		case ev := <-events:
+			evs = append(evs, ev)
+		case err := <-errc:
+			t.Fatalf("Discover returned early: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Missing events. Want %d, have %v", n, evs)
+		}
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return evs
+}
+
+func TestDNS_SRV(t *testing.T) {
+	dns := newStubDNS(t)
+	defer dns.Close()
+	dns.setSRV("_policy._tcp.example.test",
+		&net.SRV{Target: "pe1.example.test.", Port: 1111},
+		&net.SRV{Target: "pe2.example.test.", Port: 2222})
+	dns.setA("pe1.example.test", "10.0.0.1")
+	dns.setA("pe2.example.test", "10.0.0.2", "10.0.0.3")
+	d := &DNSDiscoverer{
+		Name:     "_policy._tcp.example.test.",
+		Interval: time.Hour,
+		Resolver: dns.Resolver(),
+	}
+	var have []string
+	for _, ev := range collectEvents(t, d, 3) {
+		if ev.Type != DiscoveryAdd || ev.Origin != originDNS {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+		have = append(have, ev.Addr)
+	}
+	want := []string{"10.0.0.1:1111", "10.0.0.2:2222", "10.0.0.3:2222"}
+	if !reflect.DeepEqual(want, have) {
+		t.Fatalf("Unexpected upstreams. Want %v, have %v", want, have)
+	}
+}
+
+func TestDNS_Interval(t *testing.T) {
+	d := &DNSDiscoverer{Name: "pe.example.test."}
+	if err := d.Discover(context.Background(), nil); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
+
+func TestDNS_A(t *testing.T) {
+	dns := newStubDNS(t)
+	defer dns.Close()
+	dns.setA("pe.example.test", "10.0.0.1", "10.0.0.2")
+	d := &DNSDiscoverer{
+		Name:     "pe.example.test.",
+		Port:     8080,
+		Interval: 10 * time.Millisecond,
+		Resolver: dns.Resolver(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan DiscoveryEvent)
+	go d.Discover(ctx, events)
+	for _, addr := range []string{"10.0.0.1:8080", "10.0.0.2:8080"} {
+		if ev := <-events; ev.Type != DiscoveryAdd || ev.Addr != addr {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	}
+	dns.setA("pe.example.test", "10.0.0.2")
+	for {
+		ev := <-events
+		if ev.Type == DiscoveryRemove {
+			if ev.Addr != "10.0.0.1:8080" {
+				t.Fatalf("Unexpected event: %+v", ev)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// UpstreamEventType is the type of a change in the list of upstream servers.
+type UpstreamEventType int
+
+const (
+	UpstreamAdded   UpstreamEventType = iota // Discovered or registered.
+	UpstreamUpdated                          // Announcement, flags or origins changed.
+	UpstreamExpired                          // Its lease expired.
+	UpstreamFailed                           // Its circuit opened.
+	UpstreamRemoved                          // Removed by a discoverer or the admin API.
+)
+
+var upstreamEventNames = map[UpstreamEventType]string{
+	UpstreamAdded:   "added",
+	UpstreamUpdated: "updated",
+	UpstreamExpired: "expired",
+	UpstreamFailed:  "failed",
+	UpstreamRemoved: "removed",
+}
+
+// String implements the fmt.Stringer interface.
+func (t UpstreamEventType) String() string {
+	return upstreamEventNames[t]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (t UpstreamEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (t *UpstreamEventType) UnmarshalText(b []byte) error {
+	for k, v := range upstreamEventNames {
+		if v == string(b) {
+			*t = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown upstream event type: %q", b)
+}
+
+// UpstreamEvent is a change in the list of upstream servers.
+type UpstreamEvent struct {
+	ID     uint64 // Sequence number, starting at 1.
+	Type   UpstreamEventType
+	Addr   string    // Address of the upstream server.
+	Origin string    // How the upstream server was registered.
+	Time   time.Time // When the change happened.
+}
+
+const (
+	defaultSubscriptionSize = 64               // Buffer size of subscriptions.
+	eventHistorySize        = 256              // Number of events kept to resume streams.
+	defaultEventsHeartbeat  = 15 * time.Second // Interval between heartbeats of streams.
+)
+
+// Subscription is a stream of upstream events, see Server.Subscribe.
+type Subscription struct {
+	// C is where the events are delivered. It is closed by Unsubscribe.
+	C <-chan UpstreamEvent
+
+	c       chan UpstreamEvent
+	s       *Server
+	since   uint64 // ID of the last event before the subscription.
+	dropped uint64 // Updated atomically.
+}
+
+// Subscribe returns a new subscription to the changes in the list of
+// upstream servers, with a buffer of the given size, or a default size
+// if it is not positive.
+//
+// Publishing events never blocks: when the buffer of a subscription is
+// full the event is dropped for that subscription only, and counted in
+// Dropped. Subscribers can detect the gap from the event IDs, and look
+// at the current list of upstream servers to catch up.
+func (s *Server) Subscribe(size int) *Subscription {
+	sub, _, _ := s.SubscribeSince(0, size)
+	return sub
+}
+
+// SubscribeSince is like Subscribe, but also returns the events after
+// the one with the given ID, to resume a previous subscription. It
+// returns false if some of those events are no longer available, in
+// which case the subscriber must start over from the current list of
+// upstream servers.
+func (s *Server) SubscribeSince(id uint64, size int) (*Subscription, []UpstreamEvent, bool) {
+	if size <= 0 {
+		size = defaultSubscriptionSize
+	}
+	c := make(chan UpstreamEvent, size)
+	s.submu.Lock()
+	defer s.submu.Unlock()
+	sub := &Subscription{C: c, c: c, s: s, since: s.eventID}
+	if s.subs == nil {
+		s.subs = make(map[*Subscription]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	oldest := s.eventID - uint64(len(s.history))
+	if id < oldest || id > s.eventID {
+		return sub, nil, false
+	}
+	missed := append([]UpstreamEvent(nil), s.history[id-oldest:]...)
+	return sub, missed, true
+}
+
+// Discovered returns a channel where upstream servers that are added
+// or updated are published as ip:port. They are dropped while the
+// channel is full, and it has a buffer of one.
+//
+// Deprecated: Use Subscribe, which reports every change in the list of
+// upstream servers and counts the events it drops.
+func (s *Server) Discovered() <-chan string {
+	s.discoveredOnce.Do(func() {
+		s.discovered = make(chan string, 1)
+		sub := s.Subscribe(0)
+		go func() {
+			for ev := range sub.C {
+				if ev.Type != UpstreamAdded && ev.Type != UpstreamUpdated {
+					continue
+				}
+				select {
+				case s.discovered <- ev.Addr:
+				default:
+				}
+			}
+		}()
+	})
+	return s.discovered
+}
+
+// Unsubscribe stops the delivery of events and closes sub.C. It can be
+// called more than once.
+func (sub *Subscription) Unsubscribe() {
+	s := sub.s
+	s.submu.Lock()
+	defer s.submu.Unlock()
+	if _, ok := s.subs[sub]; ok {
+		delete(s.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Dropped returns the number of events dropped because sub.C was full.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// publish delivers an event to all subscriptions, without blocking.
+// It must be called with s.mu held, so that events are numbered and
+// delivered in the order of the changes they report.
+func (s *Server) publish(typ UpstreamEventType, addr, origin string) {
+	now := s.clock()
+	s.metrics.observeEvent(typ, origin)
+	s.submu.Lock()
+	defer s.submu.Unlock()
+	s.eventID++
+	ev := UpstreamEvent{
+		ID:     s.eventID,
+		Type:   typ,
+		Addr:   addr,
+		Origin: origin,
+		Time:   now,
+	}
+	if len(s.history) == eventHistorySize {
+		s.history = append(s.history[:0], s.history[1:]...)
+	}
+	s.history = append(s.history, ev)
+	for sub := range s.subs {
+		select {
+		case sub.c <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			glog.V(2).Infof("dropped upstream event %d for slow subscriber", ev.ID)
+		}
+	}
+}
+
+func (s *Server) eventsHeartbeat() time.Duration {
+	if s.EventsHeartbeat > 0 {
+		return s.EventsHeartbeat
+	}
+	return defaultEventsHeartbeat
+}
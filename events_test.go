@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitEvent waits for the next event of the given type in sub, skipping
+// events of other types.
+func waitEvent(t *testing.T, sub *Subscription, typ UpstreamEventType) UpstreamEvent {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-sub.C:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("No %s event", typ)
+		}
+	}
+}
+
+func TestEvents_Lifecycle(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := &Server{
+		now:              clock.Now,
+		LeaseInterval:    time.Second,
+		LeaseMisses:      1,
+		FailureThreshold: 1,
+	}
+	sub := s.Subscribe(0)
+	defer sub.Unsubscribe()
+	yes := true
+	s.setUpstream("a", nil)
+	s.setUpstream("a", &Announcement{Port: 1111})
+	s.registerUpstream("b", originAdmin, nil, nil)
+	s.updateUpstream("b", nil, &yes)
+	s.recordResult("b", errors.New("down"))
+	s.recordResult("b", errors.New("down"))
+	clock.Add(2 * time.Second)
+	s.expireUpstreams()
+	s.delUpstream("b")
+	s.delUpstream("b")
+	s.updateUpstream("c", &yes, nil)
+	want := []struct {
+		typ    UpstreamEventType
+		addr   string
+		origin string
+	}{
+		{UpstreamAdded, "a", originMulticast},
+		{UpstreamUpdated, "a", originMulticast},
+		{UpstreamAdded, "b", originAdmin},
+		{UpstreamUpdated, "b", originAdmin},
+		{UpstreamFailed, "b", originAdmin},
+		{UpstreamExpired, "a", originMulticast},
+		{UpstreamRemoved, "b", originAdmin},
+	}
+	for i, w := range want {
+		select {
+		case ev := <-sub.C:
+			if ev.ID != uint64(i+1) || ev.Type != w.typ ||
+				ev.Addr != w.addr || ev.Origin != w.origin {
+				t.Fatalf("Unexpected event %d. Want %v, have %+v", i, w, ev)
+			}
+		default:
+			t.Fatalf("Missing event %d: %v", i, w)
+		}
+	}
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("Unexpected event: %+v", ev)
+	default:
+	}
+}
+
+func TestEvents_NoChange(t *testing.T) {
+	s := new(Server)
+	sub := s.Subscribe(0)
+	defer sub.Unsubscribe()
+	yes := true
+	s.setUpstream("a", &Announcement{Port: 1111, Nonce: []byte{1}})
+	s.setUpstream("a", &Announcement{Port: 1111, Nonce: []byte{2}})
+	s.setUpstream("a", nil)
+	s.registerUpstream("b", originAdmin, &yes, nil)
+	s.registerUpstream("b", originAdmin, &yes, nil)
+	s.updateUpstream("b", &yes, nil)
+	s.setUpstream("a", &Announcement{Port: 1111, Labels: map[string]string{"k": "v"}})
+	s.registerUpstream("b", originFile, nil, nil)
+	want := []struct {
+		typ  UpstreamEventType
+		addr string
+	}{
+		{UpstreamAdded, "a"},
+		{UpstreamAdded, "b"},
+		{UpstreamUpdated, "a"},
+		{UpstreamUpdated, "b"},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != w.typ || ev.Addr != w.addr {
+				t.Fatalf("Unexpected event. Want %s %s, have %+v", w.typ, w.addr, ev)
+			}
+		default:
+			t.Fatalf("No %s event for %s", w.typ, w.addr)
+		}
+	}
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("Unexpected event: %+v", ev)
+	default:
+	}
+}
+
+func TestEvents_Discovered(t *testing.T) {
+	s := new(Server)
+	c := s.Discovered()
+	s.setUpstream("127.0.0.1:1111", nil)
+	select {
+	case peer := <-c:
+		if peer != "127.0.0.1:1111" {
+			t.Fatalf("Unexpected peer. Want 127.0.0.1:1111, have %s", peer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No peer discovered")
+	}
+	if s.Discovered() != c {
+		t.Fatal("Unexpected new channel")
+	}
+}
+
+func TestEvents_Overflow(t *testing.T) {
+	s := &Server{}
+	slow := s.Subscribe(2)
+	fast := s.Subscribe(10)
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		s.registerUpstream(addr, originStatic, nil, nil)
+	}
+	if n := slow.Dropped(); n != 2 {
+		t.Fatalf("Unexpected dropped events. Want 2, have %d", n)
+	}
+	if n := fast.Dropped(); n != 0 {
+		t.Fatalf("Unexpected dropped events. Want 0, have %d", n)
+	}
+	if ev := <-slow.C; ev.Addr != "a" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	if len(fast.C) != 4 {
+		t.Fatalf("Unexpected events. Want 4, have %d", len(fast.C))
+	}
+}
+
+func TestEvents_Unsubscribe(t *testing.T) {
+	s := &Server{}
+	sub := s.Subscribe(0)
+	s.registerUpstream("a", originStatic, nil, nil)
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	s.registerUpstream("b", originStatic, nil, nil)
+	if ev, ok := <-sub.C; !ok || ev.Addr != "a" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	if ev, ok := <-sub.C; ok {
+		t.Fatalf("Unexpected event after Unsubscribe: %+v", ev)
+	}
+}
+
+func TestEvents_Text(t *testing.T) {
+	for typ := range upstreamEventNames {
+		b, err := typ.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have UpstreamEventType
+		if err = have.UnmarshalText(b); err != nil || have != typ {
+			t.Fatalf("Unexpected event type. Want %s, have %s: %v", typ, have, err)
+		}
+	}
+	var typ UpstreamEventType
+	if err := typ.UnmarshalText([]byte("bogus")); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
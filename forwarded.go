@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// viaPseudonym is how we call ourselves in the Via header.
+const viaPseudonym = "sv-api-aggregator"
+
+// parseCIDRs parses a list of CIDRs, such as 10.0.0.0/8. Bare IP
+// addresses are taken as a network of their own.
+func parseCIDRs(l []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range l {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy returns whether the client at the given IP address is
+// one of s.TrustedProxies, whose forwarding headers we extend.
+func (s *Server) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwarded sets the Forwarded, X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and Via headers of req, a request to an upstream
+// server made on behalf of the incoming request in.
+//
+// The chains of proxies in the Forwarded and X-Forwarded-For headers
+// of in are extended with its client if it is a trusted proxy, and
+// replaced otherwise, as are the protocol and host it was originally
+// made with. The Via header is always extended.
+func (s *Server) setForwarded(req, in *http.Request) {
+	client := remoteIP(in)
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	host := in.Host
+	var fwd, xff []string
+	if s.trustedProxy(client) {
+		fwd = in.Header.Values("Forwarded")
+		xff = in.Header.Values("X-Forwarded-For")
+		if v := in.Header.Get("X-Forwarded-Proto"); len(v) > 0 {
+			proto = v
+		}
+		if v := in.Header.Get("X-Forwarded-Host"); len(v) > 0 {
+			host = v
+		}
+	}
+	node := client
+	if strings.Contains(client, ":") {
+		node = "[" + client + "]"
+	}
+	fwd = append(fwd, "for="+forwardedValue(node)+
+		";proto="+forwardedValue(proto)+
+		";host="+forwardedValue(host))
+	xff = append(xff, client)
+	req.Header.Set("Forwarded", strings.Join(fwd, ", "))
+	req.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", host)
+	via := append(in.Header.Values("Via"),
+		strconv.Itoa(in.ProtoMajor)+"."+strconv.Itoa(in.ProtoMinor)+" "+viaPseudonym)
+	req.Header.Set("Via", strings.Join(via, ", "))
+}
+
+// forwardedValue returns v as a token if possible, or a quoted string
+// otherwise, for use in the Forwarded header as per RFC 7239.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return strconv.Quote(v)
+		}
+	}
+	if len(v) == 0 {
+		return `""`
+	}
+	return v
+}
+
+// isTokenChar returns whether c can be part of a token as per RFC 7230.
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
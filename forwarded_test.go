@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestForwarded_ParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}
+	if len(nets) != len(want) {
+		t.Fatalf("Unexpected networks: %v", nets)
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Fatalf("Unexpected network. Want %s, have %s", want[i], n)
+		}
+	}
+	for _, v := range []string{"10.0.0.0/33", "not an ip"} {
+		if _, err = parseCIDRs([]string{v}); err == nil {
+			t.Fatalf("Expected error didn't occur with %q", v)
+		}
+	}
+}
+
+func TestForwarded_Headers(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{TrustedProxies: trusted}
+	tests := []struct {
+		remote string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			remote: "198.51.100.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"203.0.113.1"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=203.0.113.1"},
+			},
+			want: http.Header{
+				"Forwarded":         {`for=198.51.100.1;proto=http;host="aggregator:8080"`},
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"aggregator:8080"},
+				"Via":               {"1.1 sv-api-aggregator"},
+			},
+		},
+		{
+			remote: "192.0.2.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"203.0.113.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"api.example.com"},
+				"Forwarded":         {"for=203.0.113.1"},
+				"Via":               {"1.1 lb"},
+			},
+			want: http.Header{
+				"Forwarded":         {"for=203.0.113.1, for=192.0.2.1;proto=https;host=api.example.com"},
+				"X-Forwarded-For":   {"203.0.113.1, 192.0.2.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"api.example.com"},
+				"Via":               {"1.1 lb, 1.1 sv-api-aggregator"},
+			},
+		},
+		{
+			remote: "[2001:db8::1]:1234",
+			want: http.Header{
+				"Forwarded":         {`for="[2001:db8::1]";proto=http;host="aggregator:8080"`},
+				"X-Forwarded-For":   {"2001:db8::1"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"aggregator:8080"},
+				"Via":               {"1.1 sv-api-aggregator"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		in := httptest.NewRequest("GET", "http://aggregator:8080/tables", nil)
+		in.RemoteAddr = tc.remote
+		for k, v := range tc.header {
+			in.Header[k] = v
+		}
+		req := httptest.NewRequest("GET", "http://127.0.0.1:1111/tables", nil)
+		srv.setForwarded(req, in)
+		for k, v := range tc.want {
+			if have := req.Header.Get(k); have != v[0] {
+				t.Fatalf("Unexpected %s from %s. Want %q, have %q",
+					k, tc.remote, v[0], have)
+			}
+		}
+	}
+}
+
+func TestForwarded_Upstream(t *testing.T) {
+	header := make(chan http.Header, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tables", func(w http.ResponseWriter, r *http.Request) {
+		header <- r.Header
+		fakeTables(0)(w, r)
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := new(Server)
+	srv.setUpstream(u.Host, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	req, err := http.NewRequest("GET", s.URL+"/tables", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	h := <-header
+	if have := h.Get("X-Forwarded-For"); have != "127.0.0.1" {
+		t.Fatalf("Unexpected X-Forwarded-For. Want 127.0.0.1, have %q", have)
+	}
+	if have := h.Get("Via"); have != "1.1 sv-api-aggregator" {
+		t.Fatalf("Unexpected Via: %q", have)
+	}
+}
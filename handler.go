@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // NewHandler creates and initializes an http.ServeMux that contains
@@ -11,75 +22,350 @@ import (
 func NewHandler(srv *Server) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/upstreams", handleUpstreams(srv))
+	mux.Handle("/upstreams/", handleUpstream(srv))
+	mux.Handle("/upstreams/events", handleUpstreamEvents(srv))
 	mux.Handle("/tables", handleTables(srv))
 	mux.Handle("/tables/", handleTableRows(srv))
+	mux.Handle("/metrics", handleMetrics(srv))
+	mux.Handle("/healthz", handleHealthz())
+	mux.Handle("/readyz", handleReadyz(srv))
 	return mux
 }
 
 // handleUpstreams return a JSON array containing the list of
-// upstream servers registered with this server.
+// upstream servers registered with this server, sorted by address.
+// Each upstream server is an object with its metadata, health state
+// and request statistics. See upstreamInfo for details.
+//
+// With the "format=flat" query parameter it returns a JSON array of
+// addresses instead. With "format=state" it returns a JSON object
+// mapping each upstream server to the state of its circuit breaker.
+//
+// POST requests, which need the admin token, see adminHandler,
+// register an upstream server by hand. The request body is an
+// upstreamRequest JSON object. It returns 201 (Created) and the
+// upstream server, or 200 (OK) if the upstream server already exists,
+// in which case its flags are updated.
 func handleUpstreams(srv *Server) http.HandlerFunc {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode(srv.upstreamList())
+		if r.Method == "POST" {
+			var req upstreamRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, "invalid request: "+err.Error(),
+					http.StatusBadRequest)
+				return
+			}
+			if _, _, err = net.SplitHostPort(req.Addr); err != nil {
+				http.Error(w, "invalid address: "+err.Error(),
+					http.StatusBadRequest)
+				return
+			}
+			created := srv.registerUpstream(req.Addr, originAdmin, req.Pinned, req.Drained)
+			w.Header().Set("Content-Type", "application/json")
+			if created {
+				w.Header().Set("Location", "/upstreams/"+url.PathEscape(req.Addr))
+				w.WriteHeader(http.StatusCreated)
+			}
+			json.NewEncoder(w).Encode(srv.getUpstreamInfo(req.Addr))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("format") {
+		case "flat":
+			json.NewEncoder(w).Encode(srv.upstreamList())
+		case "state":
+			json.NewEncoder(w).Encode(srv.upstreamStates())
+		default:
+			json.NewEncoder(w).Encode(srv.upstreamInfos())
+		}
+	}
+	return adminHandler(srv, corsHandler(f, "GET"), f, "POST")
+}
+
+// upstreamRequest is the request body used to register or update an
+// upstream server via the admin API. Nil flags are left unchanged.
+type upstreamRequest struct {
+	Addr    string // Address in form of ip:port, only for POST.
+	Pinned  *bool  // Whether to never remove it automatically.
+	Drained *bool  // Whether to exclude it from fan-out.
+}
+
+// handleUpstream handles requests to a single upstream server, given
+// as /upstreams/ip:port.
+//
+// GET requests return the upstream server as a JSON object, like the
+// elements of the array returned by handleUpstreams. PUT requests
+// update its flags from an upstreamRequest JSON object in the request
+// body, and return the updated upstream server. DELETE requests remove
+// the upstream server from the internal list, even if it is pinned.
+// Both need the admin token, see adminHandler.
+//
+// It returns 404 (Not Found) if the upstream server is not registered.
+func handleUpstream(srv *Server) http.HandlerFunc {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		addr := r.URL.Path[len("/upstreams/"):]
+		if srv.getUpstream(addr) == nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			var req upstreamRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, "invalid request: "+err.Error(),
+					http.StatusBadRequest)
+				return
+			}
+			if !srv.updateUpstream(addr, req.Pinned, req.Drained) {
+				http.NotFound(w, r)
+				return
+			}
+		case "DELETE":
+			srv.delUpstream(addr)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		info := srv.getUpstreamInfo(addr)
+		if info == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+	return adminHandler(srv, corsHandler(f, "GET"), f, "PUT", "DELETE")
+}
+
+// handleUpstreamEvents streams the changes in the list of upstream
+// servers as Server-Sent Events.
+//
+// The stream starts with a "snapshot" event holding the list of
+// upstream servers, like handleUpstreams. Then each UpstreamEvent is
+// sent as a JSON object, in an SSE event named after its type, such as
+// "added" or "removed". A comment is sent every s.EventsHeartbeat to
+// keep idle connections open.
+//
+// Clients that reconnect with the Last-Event-ID header get the events
+// they missed instead of the snapshot, if they are still available.
+// The stream ends when the client falls too far behind, so it can
+// reconnect and resume from where it was.
+func handleUpstreamEvents(srv *Server) http.HandlerFunc {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported",
+				http.StatusInternalServerError)
+			return
+		}
+		lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+		resume := err == nil
+		sub, missed, ok := srv.SubscribeSince(lastID, 0)
+		defer sub.Unsubscribe()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		if resume && ok {
+			for _, ev := range missed {
+				writeEvent(w, ev.ID, ev.Type.String(), ev)
+			}
+		} else {
+			writeEvent(w, sub.since, "snapshot", srv.upstreamInfos())
+		}
+		flusher.Flush()
+		heartbeat := time.NewTicker(srv.eventsHeartbeat())
+		defer heartbeat.Stop()
+		for {
+			select {
+			case ev, ok := <-sub.C:
+				if !ok || sub.Dropped() > 0 {
+					return
+				}
+				writeEvent(w, ev.ID, ev.Type.String(), ev)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case <-r.Context().Done():
+				return
+			case <-srv.context().Done():
+				return
+			}
+			flusher.Flush()
+		}
 	}
 	return corsHandler(f, "GET")
 }
 
+// writeEvent writes a single Server-Sent Event with the given id, name
+// and data encoded as JSON.
+func writeEvent(w http.ResponseWriter, id uint64, name string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, name, b)
+	return err
+}
+
 // aggregateResponse is an object used to aggregate responses from
 // multiple policy engines into a single response.
 type aggregateResponse struct {
-	URL  string
-	Data interface{}
+	URL   string
+	Data  interface{}
+	Error string `json:",omitempty"`
+}
+
+// aggregateEnvelope is the response of requests aggregated from
+// multiple policy engines. Results has the responses of the upstream
+// servers that answered, and Errors the ones that didn't, either
+// because the request failed or because their circuit is open.
+type aggregateEnvelope struct {
+	Complete bool // Whether every upstream server answered.
+	Results  []*aggregateResponse
+	Errors   []*upstreamError
+}
+
+// upstreamError is the failure of a request to an upstream server.
+type upstreamError struct {
+	URL      string
+	Class    string  // Kind of failure, see errorClass.
+	Error    string  // Error message.
+	Duration float64 // Time until the request failed, in milliseconds.
+}
+
+// aggregate makes a GET request to the given path on all upstream
+// servers concurrently, using the get function, and aggregates their
+// responses in an envelope sorted by URL. See fanoutTimeout for the
+// deadlines of the requests.
+func aggregate(srv *Server, r *http.Request, path string, get func(ctx context.Context, url string) (interface{}, error)) (*aggregateEnvelope, error) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	env := &aggregateEnvelope{
+		Results: []*aggregateResponse{},
+		Errors:  []*upstreamError{},
+	}
+	skipped := srv.foreachUpstream(withIncoming(r), timeout, func(ctx context.Context, addr string) error {
+		url := upstreamURL(srv.upstreamScheme(addr), addr, path)
+		start := time.Now()
+		data, err := get(ctx, url)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err == errTableNotFound:
+			env.Results = append(env.Results, &aggregateResponse{
+				URL:   url,
+				Error: err.Error(),
+			})
+			return nil
+		case err != nil:
+			env.Errors = append(env.Errors, &upstreamError{
+				URL:      url,
+				Class:    errorClass(err),
+				Error:    err.Error(),
+				Duration: milliseconds(time.Since(start)),
+			})
+			return err
+		}
+		env.Results = append(env.Results, &aggregateResponse{
+			URL:  url,
+			Data: data,
+		})
+		return nil
+	})
+	for _, addr := range skipped {
+		env.Errors = append(env.Errors, &upstreamError{
+			URL:   upstreamURL(srv.upstreamScheme(addr), addr, path),
+			Class: errorClass(errCircuitOpen),
+			Error: errCircuitOpen.Error(),
+		})
+	}
+	sort.Slice(env.Results, func(i, j int) bool {
+		return env.Results[i].URL < env.Results[j].URL
+	})
+	sort.Slice(env.Errors, func(i, j int) bool {
+		return env.Errors[i].URL < env.Errors[j].URL
+	})
+	env.Complete = len(env.Errors) == 0
+	recordFanout(r.Context(), len(env.Results)+len(env.Errors), len(env.Errors))
+	return env, nil
+}
+
+// requestTimeout returns the timeout of each upstream request given in
+// the "timeout" query parameter of r, as a duration such as "500ms",
+// or zero if there is none.
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("timeout")
+	if len(v) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = errors.New("must be positive")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %v", err)
+	}
+	return d, nil
+}
+
+// writeAggregate writes the aggregated response env. It returns 200
+// (OK) if every upstream server answered, and 206 (Partial Content)
+// otherwise, or 502 (Bad Gateway) if the "strict" query parameter is
+// set. The X-Upstreams-Failed header has the number of upstream servers
+// that didn't answer.
+func writeAggregate(w http.ResponseWriter, r *http.Request, env *aggregateEnvelope) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Upstreams-Failed", strconv.Itoa(len(env.Errors)))
+	if !env.Complete {
+		strict, _ := strconv.ParseBool(r.URL.Query().Get("strict"))
+		if strict {
+			w.WriteHeader(http.StatusBadGateway)
+		} else {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+	}
+	json.NewEncoder(w).Encode(env)
 }
 
 // handleTables handles requests that return a list of tables from
 // the policy engine.
 //
-// If no upstream servers are available it returns an empty JSON
-// array. In case an upstream server fails to handle the request,
-// we remove it from the list of available upstream servers until
-// it announces itself again via multicast.
-//
-// The response from this handler is a JSON object that contains
-// the URL of the upstream server being queries and its data.
+// The response from this handler is an aggregateEnvelope with the
+// URL of each upstream server queried and its data, or the reason it
+// failed. See writeAggregate for the status codes. In case an upstream
+// server fails to handle the request, the failure is also recorded in
+// its circuit breaker, and after too many failures no requests are
+// made to it for a while.
 //
 // Requests to multiple upstream servers are executed concurrently.
 func handleTables(srv *Server) http.HandlerFunc {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		data := make(chan []interface{})
-		tables := make(chan *aggregateResponse, 1)
-		go func() {
-			var d []interface{}
-			for table := range tables {
-				d = append(d, table)
-			}
-			data <- d
-		}()
-		srv.foreachUpstream(func(addr string) error {
-			url := "http://" + addr + "/tables"
-			data, err := getTables(url)
-			if err != nil {
-				return err
-			}
-			tables <- &aggregateResponse{
-				URL:  url,
-				Data: data,
-			}
-			return nil
+		env, err := aggregate(srv, r, "/tables", func(ctx context.Context, url string) (interface{}, error) {
+			return getTables(ctx, srv.httpClient(), url)
 		})
-		close(tables)
-		d := <-data
-		w.Header().Set("Content-Type", "application/json")
-		if d == nil {
-			json.NewEncoder(w).Encode([]string{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		json.NewEncoder(w).Encode(d)
+		writeAggregate(w, r, env)
 	}
 	return corsHandler(f, "GET")
 }
 
-// TODO(afiori): Make requests and aggregate responses.
+// handleTableRows handles requests that read or change the rows of
+// a table in the policy engine.
+//
+// GET requests work like handleTables, querying all upstream servers
+// concurrently and aggregating their responses. Upstream servers
+// that don't have the requested table are reported with an error
+// in their aggregateResponse, but are kept in the list of available
+// upstream servers.
+//
+// POST, PUT and DELETE requests, which need the admin token, see
+// adminHandler, are forwarded to all upstream servers concurrently.
+// See writeTableRows for details.
 func handleTableRows(srv *Server) http.HandlerFunc {
 	f := func(w http.ResponseWriter, r *http.Request) {
 		// Return 400 (Bad Request) if no table name is given.
@@ -89,8 +375,188 @@ func handleTableRows(srv *Server) http.HandlerFunc {
 			http.Error(w, http.StatusText(s), s)
 			return
 		}
+		path := "/tables/" + url.PathEscape(name)
+		if r.Method != "GET" {
+			writeTableRows(srv, w, r, path)
+			return
+		}
+		env, err := aggregate(srv, r, path, func(ctx context.Context, url string) (interface{}, error) {
+			return getTableRows(ctx, srv.httpClient(), url)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeAggregate(w, r, env)
 	}
-	return corsHandler(f, "GET")
+	return adminHandler(srv, corsHandler(f, "GET"), f, "POST", "PUT", "DELETE")
+}
+
+// consistency is the number of upstream servers that must accept a
+// write request for it to be considered successful.
+type consistency string
+
+const (
+	consistencyAll    consistency = "all"    // Every upstream.
+	consistencyQuorum consistency = "quorum" // Majority of upstreams.
+	consistencyAny    consistency = "any"    // At least one upstream.
+)
+
+// required returns the number of successful writes required out of n.
+func (c consistency) required(n int) int {
+	switch c {
+	case consistencyQuorum:
+		return n/2 + 1
+	case consistencyAny:
+		return 1
+	}
+	return n
+}
+
+// maxTableRowsBody is the maximum size of the body of write requests,
+// which is held in memory to be sent to every upstream server.
+const maxTableRowsBody = 1 << 20
+
+// writeResult is the outcome of a write request to one upstream server.
+type writeResult struct {
+	URL    string
+	Status int
+	Error  string `json:",omitempty"`
+}
+
+// writeResponse is the aggregated outcome of a write request.
+type writeResponse struct {
+	Consistency consistency
+	Required    int
+	Succeeded   int
+	Results     []*writeResult
+}
+
+// writeTableRows forwards the write request r to all upstream servers
+// concurrently, and reports the outcome for each one of them.
+//
+// The "consistency" query parameter decides whether the request
+// succeeds: "all" (the default) requires every upstream server to
+// accept the request, "quorum" requires a majority of them, and "any"
+// requires only one. It returns 502 (Bad Gateway) when that is not met,
+// and 503 (Service Unavailable) if no upstream servers are available.
+// Request bodies over maxTableRowsBody bytes are refused with 413
+// (Request Entity Too Large).
+//
+// Upstream servers that fail to handle the request at the HTTP level
+// are considered healthy. Only failures to reach them are recorded in
+// their circuit breaker.
+func writeTableRows(srv *Server, w http.ResponseWriter, r *http.Request, path string) {
+	c := consistency(r.URL.Query().Get("consistency"))
+	switch c {
+	case "":
+		c = consistencyAll
+	case consistencyAll, consistencyQuorum, consistencyAny:
+	default:
+		http.Error(w, "invalid consistency: "+string(c),
+			http.StatusBadRequest)
+		return
+	}
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxTableRowsBody))
+	if err != nil {
+		s := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, http.StatusText(s), s)
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	var mu sync.Mutex
+	resp := &writeResponse{Consistency: c, Results: []*writeResult{}}
+	srv.foreachUpstream(withIncoming(r), timeout, func(ctx context.Context, addr string) error {
+		url := upstreamURL(srv.upstreamScheme(addr), addr, path)
+		status, err := setTableRows(ctx, srv.httpClient(), r.Method, url, ct, body)
+		result := &writeResult{URL: url, Status: status}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		mu.Lock()
+		resp.Results = append(resp.Results, result)
+		if err == nil {
+			resp.Succeeded++
+		}
+		mu.Unlock()
+		if status == 0 {
+			return err
+		}
+		return nil
+	})
+	resp.Required = c.required(len(resp.Results))
+	recordFanout(r.Context(), len(resp.Results), len(resp.Results)-resp.Succeeded)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case len(resp.Results) == 0:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case resp.Succeeded < resp.Required:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleHealthz reports that the process is alive, without making any
+// requests to upstream servers.
+func handleHealthz() http.HandlerFunc {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	}
+	return corsHandler(f, "GET", "HEAD")
+}
+
+// handleReadyz reports whether the server is ready to handle requests,
+// as a readiness JSON object. It returns 200 (OK) if it is ready, and
+// 503 (Service Unavailable) otherwise.
+func handleReadyz(srv *Server) http.HandlerFunc {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		ready := srv.readiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !ready.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(ready)
+	}
+	return corsHandler(f, "GET", "HEAD")
+}
+
+// adminHandler is an http handler that passes requests with the given
+// methods, which change the state of the server, to admin if they carry
+// the bearer token srv.AdminToken, and all others to f. Responses to
+// admin requests have no CORS headers, so that browsers don't let other
+// sites make them.
+func adminHandler(srv *Server, f, admin http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method != method {
+				continue
+			}
+			if len(srv.AdminToken) == 0 {
+				http.Error(w, "admin API disabled", http.StatusForbidden)
+				return
+			}
+			auth := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(auth, []byte("Bearer "+srv.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				s := http.StatusUnauthorized
+				http.Error(w, http.StatusText(s), s)
+				return
+			}
+			admin(w, r)
+			return
+		}
+		f(w, r)
+	})
 }
 
 // corsHandler is an http handler that filters allowed request methods
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCORS_OPTIONS(t *testing.T) {
@@ -54,12 +60,12 @@ func TestCORS_MethodUnsupported(t *testing.T) {
 
 func TestHandler_Upstreams(t *testing.T) {
 	srv := new(Server)
-	srv.setUpstream("127.0.0.1:1111")
-	srv.setUpstream("127.0.0.1:2222")
+	srv.setUpstream("127.0.0.1:1111", nil)
+	srv.setUpstream("127.0.0.1:2222", nil)
 	handler := NewHandler(srv)
 	s := httptest.NewServer(handler)
 	defer s.Close()
-	resp, err := http.Get(s.URL + "/upstreams")
+	resp, err := http.Get(s.URL + "/upstreams?format=flat")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,6 +81,65 @@ func TestHandler_Upstreams(t *testing.T) {
 	if len(u) != 2 {
 		t.Fatalf("Unexpected # of upstreams. Want 2, have %d", len(u))
 	}
+	if u[0] != "127.0.0.1:1111" || u[1] != "127.0.0.1:2222" {
+		t.Fatalf("Unexpected upstreams: %v", u)
+	}
+}
+
+func TestHandler_UpstreamsInfo(t *testing.T) {
+	srv := new(Server)
+	srv.setUpstream("127.0.0.1:2222", &Announcement{
+		Port:   2222,
+		NodeID: "pts-2",
+		Labels: map[string]string{"site": "b"},
+		Source: "127.0.0.1:50000",
+	})
+	srv.setUpstream("127.0.0.1:1111", nil)
+	srv.foreachUpstream(ctx, 0, func(ctx context.Context, addr string) error {
+		if addr == "127.0.0.1:2222" {
+			return errUnexpectedStatus
+		}
+		return nil
+	})
+	handler := NewHandler(srv)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var u []upstreamInfo
+	err = json.NewDecoder(resp.Body).Decode(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u) != 2 {
+		t.Fatalf("Unexpected # of upstreams. Want 2, have %d", len(u))
+	}
+	if u[0].Addr != "127.0.0.1:1111" || u[1].Addr != "127.0.0.1:2222" {
+		t.Fatalf("Unexpected order of upstreams: %s, %s", u[0].Addr, u[1].Addr)
+	}
+	if u[0].Requests != 1 || u[0].Errors != 0 || u[0].State != stateHealthy {
+		t.Fatalf("Unexpected upstream: %+v", u[0])
+	}
+	want := upstreamInfo{
+		Addr:      "127.0.0.1:2222",
+		Source:    "127.0.0.1:50000",
+		NodeID:    "pts-2",
+		State:     stateSuspect,
+		Requests:  1,
+		Errors:    1,
+		LastError: errUnexpectedStatus.Error(),
+	}
+	have := u[1]
+	if have.Addr != want.Addr || have.Source != want.Source ||
+		have.NodeID != want.NodeID || have.Labels["site"] != "b" ||
+		have.State != want.State || have.Requests != want.Requests ||
+		have.Errors != want.Errors || have.LastError != want.LastError ||
+		have.FirstSeen.IsZero() || have.LastSeen.IsZero() {
+		t.Fatalf("Unexpected upstream. Want %+v, have %+v", want, have)
+	}
 }
 
 func fakeTables(i int) http.HandlerFunc {
@@ -82,9 +147,9 @@ func fakeTables(i int) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string][]string{
 			"table_names": {
-				string('a' + i),
-				string('b' + i),
-				string('c' + i),
+				string(rune('a' + i)),
+				string(rune('b' + i)),
+				string(rune('c' + i)),
 			},
 		})
 	}
@@ -102,7 +167,7 @@ func TestHandler_Tables(t *testing.T) {
 			t.Fatal(err)
 		}
 		// Parse the upstream server's URL to extract the port.
-		srv.setUpstream(u.Host) // Host should be ip:port.
+		srv.setUpstream(u.Host, nil) // Host should be ip:port.
 	}
 	handler := NewHandler(srv)
 	s := httptest.NewServer(handler)
@@ -115,11 +180,15 @@ func TestHandler_Tables(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Unexpected server response: %s", resp.Status)
 	}
-	var data []aggregateResponse
-	err = json.NewDecoder(resp.Body).Decode(&data)
+	var env aggregateEnvelope
+	err = json.NewDecoder(resp.Body).Decode(&env)
 	if err != nil {
 		t.Fatal(err)
 	}
+	data := env.Results
+	if !env.Complete || len(env.Errors) != 0 {
+		t.Fatalf("Unexpected errors: %+v", env.Errors)
+	}
 	if len(data) != 5 {
 		t.Fatalf("Unexpected # of records. Want 5, have %d", len(data))
 	}
@@ -133,7 +202,7 @@ func TestHandler_Tables(t *testing.T) {
 }
 
 func TestHandler_Tables_BrokenUpstream(t *testing.T) {
-	srv := new(Server)
+	srv := &Server{FailureThreshold: 1}
 	upstream := httptest.NewServer(http.NewServeMux())
 	defer upstream.Close()
 	u, err := url.Parse(upstream.URL)
@@ -141,10 +210,48 @@ func TestHandler_Tables_BrokenUpstream(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Parse the upstream server's URL to extract the port.
-	srv.setUpstream(u.Host) // Host should be ip:port.
+	srv.setUpstream(u.Host, nil) // Host should be ip:port.
 	handler := NewHandler(srv)
 	s := httptest.NewServer(handler)
 	defer s.Close()
+	tests := []struct {
+		query  string
+		status int
+		class  string
+	}{
+		{"", http.StatusPartialContent, classStatus},
+		{"?strict=true", http.StatusBadGateway, classCircuitOpen},
+	}
+	for _, tc := range tests {
+		resp, err := http.Get(s.URL + "/tables" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("Unexpected server response: %s", resp.Status)
+		}
+		if v := resp.Header.Get("X-Upstreams-Failed"); v != "1" {
+			t.Fatalf("Unexpected X-Upstreams-Failed. Want 1, have %s", v)
+		}
+		var env aggregateEnvelope
+		if err = json.NewDecoder(resp.Body).Decode(&env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Complete || len(env.Results) != 0 || len(env.Errors) != 1 {
+			t.Fatalf("Unexpected response: %+v", env)
+		}
+		e := env.Errors[0]
+		if e.URL != upstream.URL+"/tables" || e.Class != tc.class {
+			t.Fatalf("Unexpected error: %+v", e)
+		}
+	}
+}
+
+func TestHandler_Tables_NoUpstream(t *testing.T) {
+	handler := NewHandler(new(Server))
+	s := httptest.NewServer(handler)
+	defer s.Close()
 	resp, err := http.Get(s.URL + "/tables")
 	if err != nil {
 		t.Fatal(err)
@@ -153,38 +260,695 @@ func TestHandler_Tables_BrokenUpstream(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Unexpected server response: %s", resp.Status)
 	}
-	if v := resp.Header.Get("Content-Length"); v != "3" {
-		t.Fatalf("Unexpected Content-Length. Want 3, have %s", v)
+	if v := resp.Header.Get("X-Upstreams-Failed"); v != "0" {
+		t.Fatalf("Unexpected X-Upstreams-Failed. Want 0, have %s", v)
 	}
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(b, []byte("[]\n")) {
-		t.Fatalf("Unexpected response. Want []\\n, have %q", b)
+	want := `{"Complete":true,"Results":[],"Errors":[]}` + "\n"
+	if string(b) != want {
+		t.Fatalf("Unexpected response. Want %q, have %q", want, b)
 	}
 }
 
-func TestHandler_Tables_NoUpstream(t *testing.T) {
+func fakeTableRows(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tables/"+name {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{
+			"rows": {"1", "2", "3"},
+		})
+	}
+}
+
+func TestHandler_TableRows(t *testing.T) {
+	srv := new(Server)
+	for _, name := range []string{"a", "a", "b"} {
+		mux := http.NewServeMux()
+		mux.Handle("/tables/", fakeTableRows(name))
+		upstream := httptest.NewServer(mux)
+		defer upstream.Close()
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.setUpstream(u.Host, nil)
+	}
+	handler := NewHandler(srv)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/tables/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	var env aggregateEnvelope
+	err = json.NewDecoder(resp.Body).Decode(&env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := env.Results
+	if !env.Complete || len(env.Errors) != 0 {
+		t.Fatalf("Unexpected errors: %+v", env.Errors)
+	}
+	if len(data) != 3 {
+		t.Fatalf("Unexpected # of records. Want 3, have %d", len(data))
+	}
+	missing := 0
+	for _, d := range data {
+		if d.Error != "" {
+			missing++
+			continue
+		}
+		v, ok := d.Data.(map[string]interface{})
+		if !ok {
+			t.Fatalf("Unexpected data format: %#v", d.Data)
+		}
+		if _, ok = v["rows"]; !ok {
+			t.Fatalf("Missing rows key: %#v", v)
+		}
+	}
+	if missing != 1 {
+		t.Fatalf("Unexpected # of missing tables. Want 1, have %d", missing)
+	}
+	if n := len(srv.upstreamList()); n != 3 {
+		t.Fatalf("Unexpected # of upstreams. Want 3, have %d", n)
+	}
+}
+
+func TestHandler_TableRows_NoName(t *testing.T) {
 	handler := NewHandler(new(Server))
 	s := httptest.NewServer(handler)
 	defer s.Close()
-	resp, err := http.Get(s.URL + "/tables")
+	resp, err := http.Get(s.URL + "/tables/")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+}
+
+func fakeTableWrite(status int, body chan<- string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body <- r.Method + " " + string(b)
+		w.WriteHeader(status)
+	}
+}
+
+func TestHandler_TableRows_Write(t *testing.T) {
+	srv := &Server{AdminToken: testAdminToken}
+	body := make(chan string, 9)
+	statuses := []int{
+		http.StatusOK,
+		http.StatusCreated,
+		http.StatusInternalServerError,
+	}
+	for _, status := range statuses {
+		mux := http.NewServeMux()
+		mux.Handle("/tables/a", fakeTableWrite(status, body))
+		upstream := httptest.NewServer(mux)
+		defer upstream.Close()
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.setUpstream(u.Host, nil)
+	}
+	handler := NewHandler(srv)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	tests := []struct {
+		consistency string
+		status      int
+	}{
+		{"", http.StatusBadGateway},
+		{"all", http.StatusBadGateway},
+		{"quorum", http.StatusOK},
+		{"any", http.StatusOK},
+	}
+	for _, tc := range tests {
+		resp := doAdmin(t, "POST", s.URL+"/tables/a?consistency="+tc.consistency,
+			"text/plain", bytes.NewBufferString("hello"))
+		var data writeResponse
+		err := json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("Unexpected server response for %q: %s",
+				tc.consistency, resp.Status)
+		}
+		if len(data.Results) != 3 {
+			t.Fatalf("Unexpected # of results. Want 3, have %d",
+				len(data.Results))
+		}
+		if data.Succeeded != 2 {
+			t.Fatalf("Unexpected # of successes. Want 2, have %d",
+				data.Succeeded)
+		}
+		for range statuses {
+			if b := <-body; b != "POST hello" {
+				t.Fatalf("Unexpected upstream request: %q", b)
+			}
+		}
+	}
+	if n := len(srv.upstreamList()); n != 3 {
+		t.Fatalf("Unexpected # of upstreams. Want 3, have %d", n)
+	}
+}
+
+func TestHandler_TableRows_WriteBadConsistency(t *testing.T) {
+	handler := NewHandler(&Server{AdminToken: testAdminToken})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	resp := doAdmin(t, "DELETE", s.URL+"/tables/a?consistency=some", "", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+}
+
+func TestHandler_TableRows_WriteNoUpstream(t *testing.T) {
+	handler := NewHandler(&Server{AdminToken: testAdminToken})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	resp := doAdmin(t, "PUT", s.URL+"/tables/a", "", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+}
+
+func TestHandler_TableRows_WriteTooLarge(t *testing.T) {
+	handler := NewHandler(&Server{AdminToken: testAdminToken})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	body := bytes.NewReader(make([]byte, maxTableRowsBody+1))
+	resp := doAdmin(t, "POST", s.URL+"/tables/a", "text/plain", body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+}
+
+func TestHandler_TableRows_WriteAuth(t *testing.T) {
+	srv := &Server{AdminToken: testAdminToken}
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	resp, err := http.Post(s.URL+"/tables/a", "text/plain", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Unexpected server response without token: %s", resp.Status)
+	}
+	resp = doAdmin(t, "PUT", s.URL+"/tables/a", "", nil)
+	resp.Body.Close()
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); len(v) > 0 {
+		t.Fatalf("Unexpected CORS header on write request: %q", v)
+	}
+	resp = doAdmin(t, "OPTIONS", s.URL+"/tables/a", "", nil)
+	resp.Body.Close()
+	if v := resp.Header.Get("Access-Control-Allow-Method"); v != "GET, OPTIONS" {
+		t.Fatalf("Unexpected allowed methods: %q", v)
+	}
+}
+
+func TestHandler_UpstreamsState(t *testing.T) {
+	srv := &Server{FailureThreshold: 1}
+	srv.setUpstream("127.0.0.1:1111", nil)
+	srv.setUpstream("127.0.0.1:2222", nil)
+	srv.recordResult("127.0.0.1:2222", errUnexpectedStatus)
+	handler := NewHandler(srv)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/upstreams?format=state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var u map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u["127.0.0.1:1111"] != "healthy" || u["127.0.0.1:2222"] != "open" {
+		t.Fatalf("Unexpected upstream states: %v", u)
+	}
+}
+
+// testAdminToken is the admin token sent by doAdmin and doJSON.
+const testAdminToken = "s3cr3t"
+
+// doJSON makes a request with the admin token and body as JSON.
+func doJSON(t *testing.T, method, url string, body interface{}) *http.Response {
+	t.Helper()
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return doAdmin(t, method, url, "application/json", &b)
+}
+
+// doAdmin makes a request with the admin token and the given body.
+func doAdmin(t *testing.T, method, url, contentType string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHandler_UpstreamsAdmin(t *testing.T) {
+	srv := &Server{AdminToken: testAdminToken}
+	handler := NewHandler(srv)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	yes := true
+	req := &upstreamRequest{Addr: "127.0.0.1:1111", Pinned: &yes}
+	resp := doJSON(t, "POST", s.URL+"/upstreams", req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	if v := resp.Header.Get("Location"); v != "/upstreams/127.0.0.1:1111" {
+		t.Fatalf("Unexpected Location: %q", v)
+	}
+	resp = doJSON(t, "POST", s.URL+"/upstreams", req)
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Unexpected server response: %s", resp.Status)
 	}
-	if v := resp.Header.Get("Content-Length"); v != "3" {
-		t.Fatalf("Unexpected Content-Length. Want 3, have %s", v)
+	resp = doJSON(t, "PUT", s.URL+"/upstreams/127.0.0.1:1111",
+		&upstreamRequest{Drained: &yes})
+	var info upstreamInfo
+	err := json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
 	}
-	b, err := ioutil.ReadAll(resp.Body)
+	if info.Origin != originAdmin || !info.Pinned || !info.Drained {
+		t.Fatalf("Unexpected upstream: %+v", info)
+	}
+	srv.foreachUpstream(ctx, 0, func(ctx context.Context, addr string) error {
+		t.Fatalf("Unexpected request to drained upstream %s", addr)
+		return nil
+	})
+	resp = doJSON(t, "DELETE", s.URL+"/upstreams/127.0.0.1:1111", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	resp = doJSON(t, "GET", s.URL+"/upstreams/127.0.0.1:1111", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+}
+
+func TestHandler_UpstreamsAdminBadRequest(t *testing.T) {
+	handler := NewHandler(&Server{AdminToken: testAdminToken})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	resp := doJSON(t, "POST", s.URL+"/upstreams", &upstreamRequest{Addr: "x"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	resp = doJSON(t, "PUT", s.URL+"/upstreams/127.0.0.1:1111", &upstreamRequest{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+}
+
+func TestHandler_UpstreamsAdminAuth(t *testing.T) {
+	srv := new(Server)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	req := &upstreamRequest{Addr: "127.0.0.1:1111"}
+	resp := doJSON(t, "POST", s.URL+"/upstreams", req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Unexpected server response without admin token: %s", resp.Status)
+	}
+	srv.AdminToken = "other"
+	resp = doJSON(t, "POST", s.URL+"/upstreams", req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Unexpected server response with wrong token: %s", resp.Status)
+	}
+	if len(srv.upstreamList()) != 0 {
+		t.Fatalf("Unexpected upstreams: %v", srv.upstreamList())
+	}
+	srv.AdminToken = testAdminToken
+	resp = doJSON(t, "POST", s.URL+"/upstreams", req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); len(v) > 0 {
+		t.Fatalf("Unexpected CORS header on admin request: %q", v)
+	}
+	resp = doJSON(t, "OPTIONS", s.URL+"/upstreams/127.0.0.1:1111", nil)
+	resp.Body.Close()
+	if v := resp.Header.Get("Access-Control-Allow-Method"); v != "GET, OPTIONS" {
+		t.Fatalf("Unexpected allowed methods: %q", v)
+	}
+	resp = doJSON(t, "GET", s.URL+"/upstreams", nil)
+	resp.Body.Close()
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "*" {
+		t.Fatalf("Unexpected CORS header: %q", v)
+	}
+}
+
+// sseEvent is a Server-Sent Event read by readSSE.
+type sseEvent struct {
+	ID, Name, Data, Comment string
+}
+
+// readSSE reads the next Server-Sent Event from r.
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			return ev
+		}
+		if strings.HasPrefix(line, ":") {
+			ev.Comment = strings.TrimSpace(line[1:])
+			continue
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		switch kv[0] {
+		case "id":
+			ev.ID = kv[1]
+		case "event":
+			ev.Name = kv[1]
+		case "data":
+			ev.Data = kv[1]
+		}
+	}
+}
+
+// getSSE starts streaming Server-Sent Events from url.
+func getSSE(t *testing.T, url, lastID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(b, []byte("[]\n")) {
-		t.Fatalf("Unexpected response. Want []\\n, have %q", b)
+	if len(lastID) > 0 {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type: %s", ct)
+	}
+	if cors := resp.Header.Get("Access-Control-Allow-Origin"); cors != "*" {
+		t.Fatalf("Unexpected CORS header: %q", cors)
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestHandler_UpstreamEvents(t *testing.T) {
+	srv := &Server{EventsHeartbeat: time.Hour}
+	srv.registerUpstream("127.0.0.1:1111", originStatic, nil, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	resp, r := getSSE(t, s.URL+"/upstreams/events", "")
+	ev := readSSE(t, r)
+	var infos []*upstreamInfo
+	if err := json.Unmarshal([]byte(ev.Data), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Name != "snapshot" || ev.ID != "1" || len(infos) != 1 ||
+		infos[0].Addr != "127.0.0.1:1111" {
+		t.Fatalf("Unexpected snapshot: %+v", ev)
+	}
+	srv.registerUpstream("127.0.0.1:2222", originAdmin, nil, nil)
+	ev = readSSE(t, r)
+	var uev UpstreamEvent
+	if err := json.Unmarshal([]byte(ev.Data), &uev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Name != "added" || ev.ID != "2" || uev.Type != UpstreamAdded ||
+		uev.Addr != "127.0.0.1:2222" || uev.Origin != originAdmin {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	resp.Body.Close()
+
+	// Resume after missing some events.
+	srv.delUpstream("127.0.0.1:1111")
+	srv.delUpstream("127.0.0.1:2222")
+	resp, r = getSSE(t, s.URL+"/upstreams/events", "2")
+	for _, want := range []string{"3", "4"} {
+		if ev = readSSE(t, r); ev.Name != "removed" || ev.ID != want {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	}
+	resp.Body.Close()
+
+	// Start over if the events are not available.
+	resp, r = getSSE(t, s.URL+"/upstreams/events", "100")
+	if ev = readSSE(t, r); ev.Name != "snapshot" || ev.ID != "4" || ev.Data != "[]" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	resp.Body.Close()
+}
+
+func TestHandler_UpstreamEventsHeartbeat(t *testing.T) {
+	srv := &Server{EventsHeartbeat: 10 * time.Millisecond}
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	resp, r := getSSE(t, s.URL+"/upstreams/events", "")
+	defer resp.Body.Close()
+	if ev := readSSE(t, r); ev.Name != "snapshot" || ev.ID != "0" {
+		t.Fatalf("Unexpected snapshot: %+v", ev)
+	}
+	if ev := readSSE(t, r); ev.Comment != "heartbeat" {
+		t.Fatalf("Unexpected heartbeat: %+v", ev)
+	}
+}
+
+func TestHandler_Tables_Timeout(t *testing.T) {
+	srv := &Server{FailureThreshold: 1}
+	hung := make(chan struct{})
+	defer close(hung)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hung:
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.setUpstream(u.Host, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/tables?timeout=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	start := time.Now()
+	resp, err = http.Get(s.URL + "/tables?timeout=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Request took too long: %s", d)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Unexpected server response: %s", resp.Status)
+	}
+	var env aggregateEnvelope
+	if err = json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Errors) != 1 || env.Errors[0].Class != classTimeout {
+		t.Fatalf("Unexpected errors: %+v", env.Errors)
+	}
+	if st := srv.upstreamStates()[u.Host]; st != stateOpen {
+		t.Fatalf("Unexpected state. Want open, have %s", st)
+	}
+}
+
+func TestHandler_Tables_FanoutTimeout(t *testing.T) {
+	srv := &Server{FanoutTimeout: 50 * time.Millisecond}
+	hung := make(chan struct{})
+	defer close(hung)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hung:
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.setUpstream(u.Host, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/tables?timeout=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var env aggregateEnvelope
+	if err = json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Errors) != 1 || env.Errors[0].Class != classTimeout {
+		t.Fatalf("Unexpected errors: %+v", env.Errors)
+	}
+}
+
+func TestHandler_Tables_ClientGone(t *testing.T) {
+	srv := &Server{FailureThreshold: 1}
+	cancelled := make(chan struct{})
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.setUpstream(u.Host, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL+"/tables", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err = http.DefaultClient.Do(req); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Upstream request not cancelled")
+	}
+	// Wait for the fan-out to finish.
+	for i := 0; srv.getUpstream(u.Host).Stats.Requests == 0; i++ {
+		if i == 100 {
+			t.Fatal("Upstream request not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := srv.upstreamStates()[u.Host]; st != stateHealthy {
+		t.Fatalf("Unexpected state. Want healthy, have %s", st)
+	}
+}
+
+func TestHandler_HealthzReadyz(t *testing.T) {
+	srv := &Server{MinHealthyUpstreams: 1}
+	srv.Handler = NewHandler(srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + l.Addr().String()
+	h := httptest.NewServer(srv.Handler)
+	defer h.Close()
+	resp, err := http.Get(h.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status of /healthz: %s", resp.Status)
+	}
+	readyz := func(url string) (int, *readiness) {
+		t.Helper()
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r readiness
+		if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, &r
+	}
+	if status, r := readyz(h.URL); status != http.StatusServiceUnavailable ||
+		r.Ready || r.Serving || r.Discovering {
+		t.Fatalf("Unexpected readiness before starting: %d %+v", status, r)
+	}
+	go srv.Serve(l)
+	go srv.RunDiscoverers(StaticDiscoverer{"127.0.0.1:1111"})
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, r := readyz(base)
+		if status == http.StatusOK {
+			if !r.Ready || r.HealthyUpstreams != 1 || r.Upstreams != 1 {
+				t.Fatalf("Unexpected readiness: %+v", r)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Not ready in time: %d %+v", status, r)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	drained := true
+	srv.updateUpstream("127.0.0.1:1111", nil, &drained)
+	if status, r := readyz(base); status != http.StatusServiceUnavailable ||
+		r.HealthyUpstreams != 0 || !r.Serving || !r.Discovering {
+		t.Fatalf("Unexpected readiness without healthy upstreams: %d %+v", status, r)
+	}
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
 	}
 }
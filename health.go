@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// healthState is the state of the circuit breaker of an upstream server.
+//
+// Upstream servers start healthy, and become suspect when a request
+// to them fails. After s.FailureThreshold consecutive failures their
+// circuit opens and no requests are made to them, until the open
+// backoff elapses and the circuit becomes half-open. A single trial
+// request is then allowed: if it succeeds the upstream server becomes
+// healthy again, otherwise the circuit opens for twice as long as
+// before, up to s.MaxOpenBackoff.
+type healthState int
+
+const (
+	stateHealthy healthState = iota
+	stateSuspect
+	stateOpen
+	stateHalfOpen
+)
+
+var healthStateNames = map[healthState]string{
+	stateHealthy:  "healthy",
+	stateSuspect:  "suspect",
+	stateOpen:     "open",
+	stateHalfOpen: "half-open",
+}
+
+// String implements the fmt.Stringer interface.
+func (st healthState) String() string {
+	return healthStateNames[st]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (st healthState) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (st *healthState) UnmarshalText(b []byte) error {
+	for k, v := range healthStateNames {
+		if v == string(b) {
+			*st = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health state: %q", b)
+}
+
+// errCircuitOpen is the error reported for upstream servers that are
+// skipped because their circuit is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// health is the circuit breaker of an upstream server.
+type health struct {
+	State     healthState
+	Failures  int           // Consecutive failures.
+	Backoff   time.Duration // How long the circuit was last opened for.
+	OpenUntil time.Time     // When an open circuit becomes half-open.
+	trial     bool          // Whether a half-open trial is in progress.
+}
+
+// Defaults for the health configuration of Server.
+const (
+	defaultFailureThreshold = 3
+	defaultOpenBackoff      = 5 * time.Second
+	defaultMaxOpenBackoff   = time.Minute
+)
+
+// allowRequest reports whether a request can be made to the given
+// upstream server, and takes the half-open trial slot if it can.
+func (s *Server) allowRequest(addr string) bool {
+	now := s.clock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstream[addr]
+	if !ok {
+		return false
+	}
+	h := &u.Health
+	switch h.State {
+	case stateOpen:
+		if now.Before(h.OpenUntil) {
+			return false
+		}
+		glog.V(2).Infof("upstream server half-open: %s", addr)
+		h.State = stateHalfOpen
+		h.trial = true
+		return true
+	case stateHalfOpen:
+		if h.trial {
+			return false
+		}
+		h.trial = true
+	}
+	return true
+}
+
+// recordResult updates the circuit breaker of the given upstream
+// server with the result of a request made to it, and publishes an
+// UpstreamFailed event when the circuit opens.
+func (s *Server) recordResult(addr string, err error) {
+	now := s.clock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstream[addr]
+	if !ok {
+		return
+	}
+	h := &u.Health
+	h.trial = false
+	if err == nil {
+		if h.State != stateHealthy {
+			glog.V(2).Infof("upstream server healthy: %s", addr)
+		}
+		u.Health = health{}
+		return
+	}
+	h.Failures++
+	switch {
+	case h.State == stateHalfOpen:
+		h.Backoff *= 2
+		if max := s.maxOpenBackoff(); h.Backoff > max {
+			h.Backoff = max
+		}
+	case h.State == stateOpen:
+		return
+	case h.Failures >= s.failureThreshold():
+		h.Backoff = s.openBackoff()
+	default:
+		glog.V(2).Infof("upstream server suspect: %s: %v", addr, err)
+		h.State = stateSuspect
+		return
+	}
+	glog.V(2).Infof("upstream server open for %s: %s: %v", h.Backoff, addr, err)
+	h.State = stateOpen
+	h.OpenUntil = now.Add(h.Backoff)
+	s.publish(UpstreamFailed, addr, u.Origin)
+}
+
+// releaseTrial gives back the half-open trial slot of the given
+// upstream server without recording a result, so another request
+// can be made to it.
+func (s *Server) releaseTrial(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.upstream[addr]; ok {
+		u.Health.trial = false
+	}
+}
+
+// upstreamStates returns the health state of all upstream servers.
+func (s *Server) upstreamStates() map[string]healthState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := make(map[string]healthState, len(s.upstream))
+	for addr, u := range s.upstream {
+		m[addr] = u.Health.State
+	}
+	return m
+}
+
+func (s *Server) failureThreshold() int {
+	if s.FailureThreshold > 0 {
+		return s.FailureThreshold
+	}
+	return defaultFailureThreshold
+}
+
+func (s *Server) openBackoff() time.Duration {
+	if s.OpenBackoff > 0 {
+		return s.OpenBackoff
+	}
+	return defaultOpenBackoff
+}
+
+func (s *Server) maxOpenBackoff() time.Duration {
+	if s.MaxOpenBackoff > 0 {
+		return s.MaxOpenBackoff
+	}
+	return defaultMaxOpenBackoff
+}
+
+// CheckHealth periodically probes s.HealthPath on all upstream servers
+// whose circuit allows it, and records the results. It does nothing if
+// s.HealthPath or s.HealthInterval are not set.
+//
+// It is supposed to run on its own goroutine, and never returns.
+func (s *Server) CheckHealth() {
+	if len(s.HealthPath) == 0 || s.HealthInterval <= 0 {
+		return
+	}
+	glog.V(1).Infof("probing upstream servers at %s every %s",
+		s.HealthPath, s.HealthInterval)
+	for range time.Tick(s.HealthInterval) {
+		s.probeUpstreams()
+	}
+}
+
+// probeUpstreams probes all upstream servers concurrently, once.
+func (s *Server) probeUpstreams() {
+	var wg sync.WaitGroup
+	for _, addr := range s.upstreamList() {
+		if !s.allowRequest(addr) {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			url := upstreamURL(s.upstreamScheme(addr), addr, s.HealthPath)
+			err := probeHealth(s.httpClient(), url, s.HealthInterval)
+			s.recordResult(addr, err)
+		}(addr)
+	}
+	wg.Wait()
+}
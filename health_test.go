@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHealth_CircuitBreaker(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := &Server{
+		FailureThreshold: 2,
+		OpenBackoff:      time.Second,
+		MaxOpenBackoff:   3 * time.Second,
+		now:              clock.Now,
+	}
+	s.setUpstream("a", nil)
+	fail := errors.New("failed")
+	state := func(want healthState) {
+		t.Helper()
+		if have := s.upstreamStates()["a"]; have != want {
+			t.Fatalf("Unexpected state. Want %s, have %s", want, have)
+		}
+	}
+	state(stateHealthy)
+	s.recordResult("a", fail)
+	state(stateSuspect)
+	s.recordResult("a", nil)
+	state(stateHealthy)
+	s.recordResult("a", fail)
+	s.recordResult("a", fail)
+	state(stateOpen)
+	if s.allowRequest("a") {
+		t.Fatal("Request allowed with open circuit")
+	}
+	// Failed trials double the backoff, up to the max.
+	for _, backoff := range []time.Duration{1, 2, 3} {
+		clock.Add(time.Second * (backoff - 1))
+		if s.allowRequest("a") {
+			t.Fatal("Request allowed before backoff elapsed")
+		}
+		clock.Add(time.Second)
+		if !s.allowRequest("a") {
+			t.Fatal("Request not allowed after backoff elapsed")
+		}
+		state(stateHalfOpen)
+		if s.allowRequest("a") {
+			t.Fatal("Request allowed during half-open trial")
+		}
+		s.recordResult("a", fail)
+		state(stateOpen)
+	}
+	clock.Add(3 * time.Second)
+	if !s.allowRequest("a") {
+		t.Fatal("Request not allowed after backoff elapsed")
+	}
+	s.recordResult("a", nil)
+	state(stateHealthy)
+	if !s.allowRequest("a") || !s.allowRequest("a") {
+		t.Fatal("Request not allowed with closed circuit")
+	}
+}
+
+func TestHealth_Probe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	healthy := httptest.NewServer(mux)
+	defer healthy.Close()
+	broken := httptest.NewServer(http.NewServeMux())
+	defer broken.Close()
+	s := &Server{
+		HealthPath:       "/health",
+		HealthInterval:   time.Second,
+		FailureThreshold: 1,
+	}
+	for _, upstream := range []*httptest.Server{healthy, broken} {
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.setUpstream(u.Host, nil)
+	}
+	s.probeUpstreams()
+	states := s.upstreamStates()
+	for _, upstream := range []*httptest.Server{healthy, broken} {
+		u, _ := url.Parse(upstream.URL)
+		want := stateHealthy
+		if upstream == broken {
+			want = stateOpen
+		}
+		if have := states[u.Host]; have != want {
+			t.Fatalf("Unexpected state of %s. Want %s, have %s",
+				u.Host, want, have)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ReapUpstreams periodically removes upstream servers whose lease has
+// expired, that is, servers that have not announced themselves for
+// s.LeaseMisses times s.LeaseInterval.
+//
+// Only upstream servers discovered via multicast expire, and never
+// those that are pinned.
+//
+// It is supposed to run on its own goroutine. It returns right away if
+// leases are not configured, and never returns otherwise.
+func (s *Server) ReapUpstreams() {
+	if s.LeaseInterval <= 0 || s.LeaseMisses <= 0 {
+		return
+	}
+	glog.V(1).Infof("expiring upstream servers after %d missed %s intervals",
+		s.LeaseMisses, s.LeaseInterval)
+	for range time.Tick(s.LeaseInterval) {
+		s.expireUpstreams()
+	}
+}
+
+// expireUpstreams removes upstream servers whose lease has expired,
+// and returns their addresses. Those that other origins also vouch for
+// are kept, only no longer as discovered via multicast.
+func (s *Server) expireUpstreams() []string {
+	if s.LeaseInterval <= 0 || s.LeaseMisses <= 0 {
+		return nil
+	}
+	lease := s.LeaseInterval * time.Duration(s.LeaseMisses)
+	deadline := s.clock().Add(-lease)
+	var expired []string
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, u := range s.upstream {
+		if u.Pinned || !u.hasOrigin(originMulticast) || !u.LastSeen.Before(deadline) {
+			continue
+		}
+		u.delOrigin(originMulticast)
+		if len(u.Origins) > 0 {
+			s.publish(UpstreamUpdated, addr, u.Origin)
+			continue
+		}
+		glog.V(2).Infof("upstream server expired: %s", addr)
+		delete(s.upstream, addr)
+		expired = append(expired, addr)
+		s.publish(UpstreamExpired, addr, originMulticast)
+	}
+	return expired
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time      { return c.t }
+func (c *fakeClock) Add(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLease_Expire(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := &Server{
+		LeaseInterval: 10 * time.Second,
+		LeaseMisses:   3,
+		now:           clock.Now,
+	}
+	s.setUpstream("a", nil)
+	s.setUpstream("b", nil)
+	u := s.getUpstream("a")
+	if !u.FirstSeen.Equal(clock.t) || !u.LastSeen.Equal(clock.t) {
+		t.Fatalf("Unexpected first/last seen: %+v", u)
+	}
+	clock.Add(20 * time.Second)
+	s.setUpstream("b", nil) // Renew the lease of b.
+	if expired := s.expireUpstreams(); len(expired) != 0 {
+		t.Fatalf("Unexpected expired upstreams: %v", expired)
+	}
+	clock.Add(11 * time.Second)
+	expired := s.expireUpstreams()
+	if len(expired) != 1 || expired[0] != "a" {
+		t.Fatalf("Unexpected expired upstreams. Want [a], have %v", expired)
+	}
+	u = s.getUpstream("b")
+	if u == nil {
+		t.Fatal("Upstream b expired")
+	}
+	if !u.FirstSeen.Equal(time.Unix(1000, 0)) || !u.LastSeen.Equal(time.Unix(1020, 0)) {
+		t.Fatalf("Unexpected first/last seen: %+v", u)
+	}
+	clock.Add(30 * time.Second)
+	if expired = s.expireUpstreams(); len(expired) != 1 {
+		t.Fatalf("Unexpected expired upstreams. Want [b], have %v", expired)
+	}
+}
+
+func TestLease_Disabled(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := &Server{LeaseInterval: time.Second, now: clock.Now}
+	s.setUpstream("a", nil)
+	clock.Add(time.Hour)
+	if expired := s.expireUpstreams(); len(expired) != 0 {
+		t.Fatalf("Unexpected expired upstreams: %v", expired)
+	}
+}
+
+func TestLease_PinnedAndAdmin(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := &Server{
+		LeaseInterval: time.Second,
+		LeaseMisses:   1,
+		now:           clock.Now,
+	}
+	yes := true
+	s.setUpstream("a", nil)
+	s.updateUpstream("a", &yes, nil)
+	s.registerUpstream("b", originAdmin, nil, nil)
+	s.setUpstream("c", nil)
+	clock.Add(time.Hour)
+	expired := s.expireUpstreams()
+	if len(expired) != 1 || expired[0] != "c" {
+		t.Fatalf("Unexpected expired upstreams. Want [c], have %v", expired)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -18,9 +25,59 @@ var Version = "tip"
 func main() {
 	cpus := flag.Int("cpus", 0, "how many cpus to use (0=all)")
 	laddr := flag.String("http_addr", ":8080", "address in form of ip:port to listen on for http")
-	lmaddr := flag.String("multicast_addr", "224.0.0.1:8888", "address in form of ip:port to listen on for multicast")
+	lmaddr := flag.String("multicast_addr", "224.0.0.1:8888", "address in form of ip:port to listen on for multicast (empty=disabled)")
 	maddr := flag.String("multicast_ping", "", "address in form of ip:port to announce ourselves via multicast")
+	miface := flag.String("multicast_iface", "", "comma separated list of names or addresses of network interfaces to listen on for multicast")
+	mpiface := flag.String("multicast_ping_iface", "", "comma separated list of names or addresses of network interfaces to announce ourselves on (default=multicast_iface)")
+	mttl := flag.Int("multicast_ttl", 1, "TTL or hop limit of multicast announcements")
+	mloop := flag.Bool("multicast_loopback", true, "whether to deliver multicast announcements to this host")
 	mintvl := flag.Duration("multicast_interval", 30*time.Second, "interval between multicast pings")
+	nodeID := flag.String("node_id", hostname(), "node id to send in multicast announcements")
+	labels := flag.String("node_labels", "", "comma separated list of key=value labels to send in multicast announcements")
+	keyFile := flag.String("multicast_key_file", "", "file containing a shared key to sign and authenticate multicast announcements")
+	leaseMisses := flag.Int("multicast_lease", 3, "number of missed multicast intervals after which upstream servers expire (0=never)")
+	window := flag.Duration("multicast_replay_window", defaultReplayWindow, "maximum clock skew of signed multicast announcements")
+	seeds := flag.String("upstreams", "", "comma separated list of upstream servers in form of ip:port")
+	seedFile := flag.String("upstreams_file", "", "file listing upstream servers, as a JSON array or one ip:port per line")
+	seedIntvl := flag.Duration("upstreams_file_interval", 5*time.Second, "interval between checks for changes in the upstreams file")
+	dnsName := flag.String("upstreams_dns", "", "DNS name to look up upstream servers, as SRV records or A/AAAA records with -upstreams_dns_port")
+	dnsPort := flag.Int("upstreams_dns_port", 0, "port of upstream servers looked up as A/AAAA records (0=use SRV records)")
+	dnsIntvl := flag.Duration("upstreams_dns_interval", 30*time.Second, "interval between DNS lookups of upstream servers")
+	healthPath := flag.String("health_path", "/tables", "path to probe on upstream servers to check their health")
+	healthIntvl := flag.Duration("health_interval", 10*time.Second, "interval between health probes (0=never)")
+	failures := flag.Int("health_failures", defaultFailureThreshold, "number of consecutive failures after which requests to an upstream server stop")
+	backoff := flag.Duration("health_backoff", defaultOpenBackoff, "how long to stop requests to a failing upstream server at first")
+	maxBackoff := flag.Duration("health_max_backoff", defaultMaxOpenBackoff, "maximum time to stop requests to a failing upstream server")
+	fanoutTimeout := flag.Duration("fanout_timeout", defaultFanoutTimeout, "how long requests to all upstream servers can take overall")
+	upstreamTimeout := flag.Duration("upstream_timeout", defaultUpstreamTimeout, "how long each request to an upstream server can take, unless overridden by the timeout query parameter")
+	maxIdle := flag.Int("upstream_max_idle_conns", defaultMaxIdleConnsPerHost, "number of idle connections kept open to each upstream server")
+	maxConns := flag.Int("upstream_max_conns", 0, "maximum number of connections to each upstream server (0=unlimited)")
+	idleTimeout := flag.Duration("upstream_idle_timeout", defaultIdleConnTimeout, "how long idle connections to upstream servers are kept open")
+	dialTimeout := flag.Duration("upstream_dial_timeout", defaultDialTimeout, "how long connecting to an upstream server can take")
+	tlsTimeout := flag.Duration("upstream_tls_timeout", defaultTLSHandshakeTimeout, "how long TLS handshakes with upstream servers can take")
+	http2 := flag.Bool("upstream_http2", false, "whether to use HTTP/2 with upstream servers over TLS")
+	scheme := flag.String("upstream_scheme", "http", "URL scheme of upstream servers that do not announce https, http or https")
+	caFile := flag.String("upstream_ca_file", "", "PEM file of the CAs to verify the certificates of upstream servers (default=system CAs)")
+	certFile := flag.String("upstream_cert_file", "", "PEM file of the client certificate presented to upstream servers")
+	certKeyFile := flag.String("upstream_key_file", "", "PEM file of the key of the client certificate presented to upstream servers")
+	serverNames := flag.String("upstream_server_names", "", "comma separated list of ip:port=name pairs overriding the TLS server name of upstream servers")
+	pins := flag.String("upstream_pins", "", "comma separated list of ip:port=pin pairs, the pin being the base64 encoded SHA-256 hash of the public key of the certificate of upstream servers")
+	tokenFile := flag.String("upstream_token_file", "", "file containing a bearer token to send to upstream servers")
+	basicAuth := flag.String("upstream_basic_auth_file", "", "file containing a username:password pair to send to upstream servers with basic auth")
+	secretsFile := flag.String("upstream_secrets_file", "", "JSON file mapping upstream servers to their token or username and password")
+	secretsIntvl := flag.Duration("upstream_secrets_interval", 5*time.Second, "interval between checks for changes in the secrets file")
+	insecureAuth := flag.Bool("upstream_insecure_auth", false, "whether to send credentials to upstream servers over plain http")
+	forwardAuth := flag.String("forward_auth", "never", "whether to forward the Authorization header of callers to upstream servers: never, always, or fallback when there are no credentials")
+	adminTokenFile := flag.String("admin_token_file", "", "file containing the bearer token required to change upstream servers at /upstreams and their tables at /tables (default=refused)")
+	trusted := flag.String("trusted_proxies", "", "comma separated list of CIDRs of proxies whose X-Forwarded-For and Forwarded headers are extended rather than replaced")
+	minHealthy := flag.Int("ready_min_upstreams", 1, "number of healthy upstream servers required for /readyz to report ready")
+	accessLog := flag.String("access_log", "", "where to log http requests: stderr, syslog or a file name (default=glog with -v 1)")
+	accessFormat := flag.String("access_log_format", accessFormatGlog, "format of the access log: glog, json or combined")
+	accessMaxSize := flag.Int64("access_log_max_size", 100, "size in megabytes after which the access log file is rotated (0=never)")
+	accessMaxAge := flag.Duration("access_log_max_age", 24*time.Hour, "age after which the access log file is rotated (0=never)")
+	accessKeep := flag.Int("access_log_keep", 7, "number of rotated access log files to keep (0=all)")
+	heartbeat := flag.Duration("events_heartbeat", defaultEventsHeartbeat, "interval between heartbeats of the upstream events stream")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
 	version := flag.Bool("version", false, "show version and exit")
 	flag.Parse()
 	if *version {
@@ -34,20 +91,199 @@ func main() {
 		*cpus = runtime.NumCPU()
 	}
 	runtime.GOMAXPROCS(*cpus)
+	var key []byte
+	if len(*keyFile) > 0 {
+		b, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		key = bytes.TrimSpace(b)
+		if len(key) == 0 {
+			glog.Fatalf("multicast key file %s is empty", *keyFile)
+		}
+	}
+	if *scheme != "http" && *scheme != "https" {
+		glog.Fatalf("invalid upstream scheme %q", *scheme)
+	}
+	if *minHealthy < 0 {
+		glog.Fatalf("invalid minimum of healthy upstream servers %d", *minHealthy)
+	}
+	if *seedIntvl <= 0 {
+		glog.Fatalf("invalid upstreams file interval %s", *seedIntvl)
+	}
+	if *dnsIntvl <= 0 {
+		glog.Fatalf("invalid upstreams DNS interval %s", *dnsIntvl)
+	}
+	if *secretsIntvl <= 0 {
+		glog.Fatalf("invalid upstream secrets interval %s", *secretsIntvl)
+	}
+	tlsConfig, err := loadTLSConfig(*caFile, *certFile, *certKeyFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	pinned, err := parsePins(parseLabels(*pins))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	creds, err := loadCredentials(*tokenFile, *basicAuth, *secretsFile, *secretsIntvl)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	forward, err := parseForwardPolicy(*forwardAuth)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var adminToken string
+	if len(*adminTokenFile) > 0 {
+		b, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if b = bytes.TrimSpace(b); len(b) == 0 {
+			glog.Fatalf("admin token file %s is empty", *adminTokenFile)
+		}
+		adminToken = string(b)
+	}
+	proxies, err := parseCIDRs(splitList(*trusted))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	format, err := parseAccessFormat(*accessFormat)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var access *AccessLog
+	if len(*accessLog) > 0 {
+		out, err := openAccessLog(*accessLog, *accessMaxSize<<20, *accessMaxAge, *accessKeep)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		access = &AccessLog{Format: format, Out: out}
+	}
 	s := &Server{
 		Addr:          *laddr,
 		MulticastAddr: *lmaddr,
+		MulticastKey:  key,
+		ReplayWindow:  *window,
+		LeaseInterval: *mintvl,
+		LeaseMisses:   *leaseMisses,
+
+		MulticastInterfaces: splitList(*miface),
+
+		HealthPath:       *healthPath,
+		HealthInterval:   *healthIntvl,
+		FailureThreshold: *failures,
+		OpenBackoff:      *backoff,
+		MaxOpenBackoff:   *maxBackoff,
+
+		Transport: TransportConfig{
+			MaxIdleConnsPerHost: *maxIdle,
+			MaxConnsPerHost:     *maxConns,
+			IdleConnTimeout:     *idleTimeout,
+			DialTimeout:         *dialTimeout,
+			TLSHandshakeTimeout: *tlsTimeout,
+			HTTP2:               *http2,
+			TLS:                 tlsConfig,
+			ServerNames:         parseLabels(*serverNames),
+			Pins:                pinned,
+		},
+		Scheme:              *scheme,
+		Credentials:         creds,
+		ForwardAuth:         forward,
+		InsecureCredentials: *insecureAuth,
+		TrustedProxies:      proxies,
+		FanoutTimeout:       *fanoutTimeout,
+		UpstreamTimeout:     *upstreamTimeout,
+		EventsHeartbeat:     *heartbeat,
+
+		MinHealthyUpstreams: *minHealthy,
+		AccessLog:           access,
+		AdminToken:          adminToken,
 	}
 	s.Handler = NewHandler(s)
-	go func() { glog.Fatal(s.ListenAndServe()) }()
-	go func() { glog.Fatal(s.Discover()) }()
+	var ds []Discoverer
+	if len(*lmaddr) > 0 {
+		ds = append(ds, s.Multicast())
+	}
+	if len(*seeds) > 0 {
+		ds = append(ds, StaticDiscoverer(splitList(*seeds)))
+	}
+	if len(*seedFile) > 0 {
+		ds = append(ds, &FileDiscoverer{Name: *seedFile, Interval: *seedIntvl})
+	}
+	if len(*dnsName) > 0 {
+		ds = append(ds, &DNSDiscoverer{
+			Name:     *dnsName,
+			Port:     *dnsPort,
+			Interval: *dnsIntvl,
+		})
+	}
+	go func() {
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			glog.Fatal(err)
+		}
+	}()
+	go func() {
+		if err := s.RunDiscoverers(ds...); err != nil {
+			glog.Fatal(err)
+		}
+	}()
+	go s.ReapUpstreams()
+	go s.CheckHealth()
+	stop := make(chan struct{})
+	done := make(chan struct{})
 	if len(*maddr) > 0 {
-		go announce(*mintvl, *maddr, *laddr)
+		a := &Announcement{
+			NodeID: *nodeID,
+			Scheme: "http",
+			Labels: parseLabels(*labels),
+		}
+		ifaces := splitList(*mpiface)
+		if len(ifaces) == 0 {
+			ifaces = splitList(*miface)
+		}
+		opts := []MulticastOptions{{TTL: *mttl, NoLoopback: !*mloop}}
+		if len(ifaces) > 0 {
+			opts = nil
+			for _, ifi := range ifaces {
+				opts = append(opts, MulticastOptions{
+					Interface:  ifi,
+					TTL:        *mttl,
+					NoLoopback: !*mloop,
+				})
+			}
+		}
+		go func() {
+			announce(*mintvl, *maddr, *laddr, a, key, opts, stop)
+			close(done)
+		}()
+	} else {
+		close(done)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	glog.Infof("received %s, shutting down", <-sig)
+	close(stop)
+	<-done
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		glog.Errorf("shutdown: %v", err)
 	}
-	select {} // Block forever.
+	if access != nil {
+		if err := access.Close(); err != nil {
+			glog.Errorf("access log: %v", err)
+		}
+	}
+	glog.Flush()
 }
 
-func announce(interval time.Duration, multicast_addr, http_addr string) {
+// announce sends the announcement a to multicast_addr every interval,
+// with the port number set to the one in http_addr. Announcements are
+// signed if key is not nil, and sent once with each of the options.
+//
+// When stop is closed it sends a goodbye announcement and returns.
+func announce(interval time.Duration, multicast_addr, http_addr string, a *Announcement, key []byte, opts []MulticastOptions, stop <-chan struct{}) {
 	glog.Infof("sending announcements to %s every %s",
 		multicast_addr, interval)
 	_, port, err := net.SplitHostPort(http_addr)
@@ -58,9 +294,101 @@ func announce(interval time.Duration, multicast_addr, http_addr string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	v := uint16(p)
+	a.Port = uint16(p)
+	send := func() {
+		for _, o := range opts {
+			err := MulticastAnnounce(multicast_addr, a, key, o)
+			if err != nil {
+				glog.Errorf("multicast announcement on %q: %v", o.Interface, err)
+			}
+		}
+	}
 	for {
-		MulticastPing(multicast_addr, v)
-		time.Sleep(interval)
+		send()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			glog.Infof("sending goodbye announcement to %s", multicast_addr)
+			a.Goodbye = true
+			send()
+			return
+		}
+	}
+}
+
+// loadCredentials returns the credentials of upstream servers given
+// in at most one of a token file, a basic auth file with a
+// username:password pair, or a secrets file, or nil if none is set.
+func loadCredentials(tokenFile, basicAuthFile, secretsFile string, interval time.Duration) (Credentials, error) {
+	n := 0
+	for _, name := range []string{tokenFile, basicAuthFile, secretsFile} {
+		if len(name) > 0 {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("only one of token, basic auth and secrets files can be set")
+	}
+	switch {
+	case len(tokenFile) > 0:
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if b = bytes.TrimSpace(b); len(b) == 0 {
+			return nil, fmt.Errorf("token file %s is empty", tokenFile)
+		}
+		return BearerToken(b), nil
+	case len(basicAuthFile) > 0:
+		b, err := ioutil.ReadFile(basicAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		p := strings.SplitN(string(bytes.TrimSpace(b)), ":", 2)
+		if len(p) != 2 || len(p[0]) == 0 {
+			return nil, fmt.Errorf("basic auth file %s is not in form of username:password", basicAuthFile)
+		}
+		return &BasicAuth{Username: p[0], Password: p[1]}, nil
+	case len(secretsFile) > 0:
+		f := &SecretsFile{Name: secretsFile, Interval: interval}
+		if err := f.Load(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, nil
+}
+
+// hostname returns the name of this host, or an empty string.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// parseLabels parses a comma separated list of key=value pairs.
+func parseLabels(s string) map[string]string {
+	if len(s) == 0 {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) == 2 {
+			m[p[0]] = p[1]
+		} else {
+			m[p[0]] = ""
+		}
 	}
+	return m
 }
@@ -1,86 +1,459 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
-const maxDatagramSize = 32
+// maxDatagramSize is the maximum size of announcement packets.
+const maxDatagramSize = 1024
 
 // Discover starts a UDP server to listen for multicast packets for
 // service discovery. When it learns about a new upstream server it
-// keeps it in an internal list until a request to that server fails.
+// keeps it in an internal list until its lease expires.
+//
+// If s.MulticastKey is set, packets that are not signed with that key
+// or that are replays of previous packets are dropped.
+//
+// Upstream servers that send a goodbye announcement are removed from
+// the internal list right away, unless they are pinned.
 //
 // The optional "ready" argument can be used to notify when this
-// server is up and running. It is supposed to run on its own goroutine.
+// server is up and running. It is supposed to run on its own goroutine,
+// and returns nil after Shutdown.
+//
+// It is a shortcut for running s.Multicast() with RunDiscoverers.
 func (s *Server) Discover(ready ...chan struct{}) error {
+	d := &multicastDiscoverer{s: s}
+	if ready != nil {
+		d.ready = ready[0]
+	}
+	return s.RunDiscoverers(d)
+}
+
+// Multicast returns a Discoverer of the upstream servers that announce
+// themselves via multicast on s.MulticastAddr. See Discover.
+func (s *Server) Multicast() Discoverer {
+	return &multicastDiscoverer{s: s}
+}
+
+// multicastDiscoverer is a Discoverer of the upstream servers that
+// announce themselves via multicast.
+type multicastDiscoverer struct {
+	s     *Server
+	ready chan struct{} // Closed when listening, if not nil.
+}
+
+// Discover implements the Discoverer interface.
+func (d *multicastDiscoverer) Discover(ctx context.Context, events chan<- DiscoveryEvent) error {
+	s := d.s
 	glog.V(1).Infoln("starting discovery server on", s.MulticastAddr)
 	addr, err := net.ResolveUDPAddr("udp", s.MulticastAddr)
 	if err != nil {
 		return err
 	}
-	l, err := net.ListenMulticastUDP("udp", nil, addr)
+	ifis, err := s.multicastInterfaces(addr)
 	if err != nil {
 		return err
 	}
-	l.SetReadBuffer(maxDatagramSize)
-	b := make([]byte, 2)
-	for {
-		if ready != nil {
-			close(ready[0])
-			ready = nil
+	var ifi *net.Interface
+	if len(ifis) > 0 {
+		ifi = ifis[0]
+	}
+	l, err := net.ListenMulticastUDP(udpNetwork(addr), ifi, addr)
+	if err != nil {
+		return err
+	}
+	if len(ifis) > 1 {
+		if err = joinGroup(l, addr, ifis[1:]); err != nil {
+			l.Close()
+			return err
 		}
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	if d.ready != nil {
+		close(d.ready)
+	}
+	b := make([]byte, maxDatagramSize)
+	for {
 		n, src, err := l.ReadFromUDP(b)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
-		if n != 2 {
+		var a Announcement
+		if err = a.UnmarshalBinary(b[:n]); err != nil {
+			atomic.AddUint64(&s.rejected.Malformed, 1)
 			glog.Errorf("received malformed UDP with %d bytes from %s: %v",
-				n, src, b)
+				n, src, err)
 			continue
 		}
-		glog.V(2).Infof("received %d bytes UDP from %s: %v", n, src, b)
-		port := binary.BigEndian.Uint16(b)
-		host, _, err := net.SplitHostPort(src.String())
+		if s.MulticastKey != nil {
+			if err = s.authenticate(b[:n], &a); err != nil {
+				glog.Errorf("rejected UDP with %d bytes from %s: %v",
+					n, src, err)
+				continue
+			}
+		}
+		glog.V(2).Infof("received %d bytes UDP from %s: %+v", n, src, a)
+		a.Source = src.String()
+		a.Verified = s.MulticastKey != nil
+		ev := DiscoveryEvent{
+			Type:         DiscoveryAdd,
+			Addr:         peerAddr(src, a.Port),
+			Origin:       originMulticast,
+			Announcement: &a,
+		}
+		if a.Goodbye {
+			ev.Type = DiscoveryRemove
+		}
+		if !sendEvent(ctx, events, ev) {
+			return nil
+		}
+	}
+}
+
+// peerAddr returns the address of the upstream server that sent an
+// announcement from src, with the given port. IPv6 addresses are
+// bracketed, and keep the zone of link-local addresses.
+func peerAddr(src *net.UDPAddr, port uint16) string {
+	host := src.IP.String()
+	if len(src.Zone) > 0 {
+		host += "%" + src.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// multicastInterfaces returns the network interfaces to listen for
+// multicast on: those in s.MulticastInterfaces, or the one in the zone
+// of addr. It returns no interfaces to let the system choose.
+func (s *Server) multicastInterfaces(addr *net.UDPAddr) ([]*net.Interface, error) {
+	var ifis []*net.Interface
+	for _, name := range s.MulticastInterfaces {
+		ifi, err := findInterface(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		peer := host + ":" + strconv.Itoa(int(port))
-		s.setUpstream(peer)
+		ifis = append(ifis, ifi)
+	}
+	if len(ifis) == 0 && len(addr.Zone) > 0 {
+		ifi, err := zoneInterface(addr.Zone)
+		if err != nil {
+			return nil, err
+		}
+		ifis = append(ifis, ifi)
+	}
+	return ifis, nil
+}
+
+// joinGroup joins the multicast group addr on the given interfaces,
+// in addition to the ones the connection c already joined.
+func joinGroup(c *net.UDPConn, addr *net.UDPAddr, ifis []*net.Interface) error {
+	group := &net.UDPAddr{IP: addr.IP}
+	for _, ifi := range ifis {
+		var err error
+		if addr.IP.To4() != nil {
+			err = ipv4.NewPacketConn(c).JoinGroup(ifi, group)
+		} else {
+			err = ipv6.NewPacketConn(c).JoinGroup(ifi, group)
+		}
+		if err != nil {
+			return fmt.Errorf("joining %s on %s: %v", addr.IP, ifi.Name, err)
+		}
+	}
+	return nil
+}
+
+// findInterface returns the network interface with the given name,
+// or the one that has the given IP address.
+func findInterface(name string) (*net.Interface, error) {
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return net.InterfaceByName(name)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no network interface with address %s", ip)
+}
+
+// udpNetwork returns the network of the given address, udp4 or udp6.
+func udpNetwork(addr *net.UDPAddr) string {
+	if addr.IP.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// zoneInterface returns the network interface of an IPv6 zone, which
+// is either an interface name or index.
+func zoneInterface(zone string) (*net.Interface, error) {
+	if n, err := strconv.Atoi(zone); err == nil {
+		return net.InterfaceByIndex(n)
+	}
+	return net.InterfaceByName(zone)
+}
+
+// defaultReplayWindow is the default for Server.ReplayWindow.
+const defaultReplayWindow = time.Minute
+
+// authenticate checks that the packet b, decoded as a, is signed with
+// our multicast key and is not a replay of a previous packet. Signed
+// packets are replays if their timestamp is not within the replay
+// window of our clock, or if their nonce was already seen.
+//
+// Each rejected packet is counted in s.rejected.
+func (s *Server) authenticate(b []byte, a *Announcement) error {
+	err := verifyPacket(b, s.MulticastKey)
+	if err == nil && (a.Timestamp.IsZero() || len(a.Nonce) == 0) {
+		err = errUnsigned
+	}
+	if err == nil && !s.nonces.add(a.Nonce, a.Timestamp, s.clock(), s.replayWindow()) {
+		err = errReplayed
+	}
+	switch err {
+	case errUnsigned:
+		atomic.AddUint64(&s.rejected.Unsigned, 1)
+	case errForged:
+		atomic.AddUint64(&s.rejected.Forged, 1)
+	case errReplayed:
+		atomic.AddUint64(&s.rejected.Replayed, 1)
+	}
+	return err
+}
+
+// replayWindow returns s.ReplayWindow or its default.
+func (s *Server) replayWindow() time.Duration {
+	if s.ReplayWindow > 0 {
+		return s.ReplayWindow
+	}
+	return defaultReplayWindow
+}
+
+// RejectedAnnouncements returns the number of announcement packets
+// rejected by Discover since the server started.
+func (s *Server) RejectedAnnouncements() RejectedAnnouncements {
+	return RejectedAnnouncements{
+		Malformed: atomic.LoadUint64(&s.rejected.Malformed),
+		Unsigned:  atomic.LoadUint64(&s.rejected.Unsigned),
+		Forged:    atomic.LoadUint64(&s.rejected.Forged),
+		Replayed:  atomic.LoadUint64(&s.rejected.Replayed),
 	}
 }
 
-// Discovered returns a channel where newly discovered peers are
-// published as ip:port.
-func (s *Server) Discovered() <-chan string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.usev == nil {
-		s.usev = make(chan string, 1)
+// RejectedAnnouncements counts announcement packets rejected by
+// Discover, by reason.
+type RejectedAnnouncements struct {
+	Malformed uint64 // Packets that could not be decoded.
+	Unsigned  uint64 // Packets without a signature.
+	Forged    uint64 // Packets with an invalid signature.
+	Replayed  uint64 // Packets already seen, or out of the time window.
+}
+
+// nonceCache remembers the nonces of recently seen packets.
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Nonce to packet timestamp.
+}
+
+// add records the nonce of a packet signed at time ts. It returns false
+// if ts is not within window of now, or if the nonce was already
+// recorded. Nonces older than window are forgotten.
+func (c *nonceCache) add(nonce []byte, ts, now time.Time, window time.Duration) bool {
+	if ts.Before(now.Add(-window)) || ts.After(now.Add(window)) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	for k, t := range c.seen {
+		if t.Before(now.Add(-window)) {
+			delete(c.seen, k)
+		}
+	}
+	k := string(nonce)
+	if _, ok := c.seen[k]; ok {
+		return false
 	}
-	return s.usev
+	c.seen[k] = ts
+	return true
+}
+
+// MulticastOptions configures the sockets used to send multicast packets.
+type MulticastOptions struct {
+	Interface  string // Name or address of the interface to send from.
+	TTL        int    // TTL (IPv4) or hop limit (IPv6), 0 for default.
+	NoLoopback bool   // Whether to not deliver packets to this host.
 }
 
 // MulticastPing sends a UDP multicast packet containing a port number
-// encoded as uint16 in the payload. This is used to announce ourselves
-// to other servers like this, which are listening for announcements
-// using the Discover function.
-func MulticastPing(addr string, port uint16) error {
+// encoded as uint16 in the payload, the legacy announcement format.
+// This is used to announce ourselves to other servers like this, which
+// are listening for announcements using the Discover function.
+//
+// The address can be an IPv4 or IPv6 group. Link-local IPv6 groups
+// must have a zone, as in [ff02::1%eth0]:8888, unless an interface
+// is given in the optional "opts" argument.
+func MulticastPing(addr string, port uint16, opts ...MulticastOptions) error {
 	glog.V(2).Infof("sending multicast ping to %s with value %v", addr, port)
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, port)
+	return multicastSend(addr, b, opts...)
+}
+
+// MulticastAnnounce sends a UDP multicast packet containing the given
+// announcement encoded in the current protocol version. Like with
+// MulticastPing, the port number must be set in the announcement.
+//
+// If key is not nil the packet is signed with it. See Announcement.Sign.
+func MulticastAnnounce(addr string, a *Announcement, key []byte, opts ...MulticastOptions) error {
+	glog.V(2).Infof("sending multicast announcement to %s with value %+v", addr, a)
+	var b []byte
+	var err error
+	if key != nil {
+		b, err = a.Sign(key)
+	} else {
+		b, err = a.MarshalBinary()
+	}
+	if err != nil {
+		return err
+	}
+	return multicastSend(addr, b, opts...)
+}
+
+// multicastSend sends the packet b to the multicast address addr,
+// using the optional socket options. The socket is bound to an address
+// of the interface in the options, if any, so that packets have it as
+// source address.
+func multicastSend(addr string, b []byte, opts ...MulticastOptions) error {
 	a, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return err
 	}
-	c, err := net.DialUDP("udp", nil, a)
+	var ifi *net.Interface
+	laddr := new(net.UDPAddr)
+	if opts != nil && len(opts[0].Interface) > 0 {
+		if ifi, err = findInterface(opts[0].Interface); err != nil {
+			return err
+		}
+		if laddr, err = interfaceAddr(ifi, opts[0].Interface, a); err != nil {
+			return err
+		}
+	}
+	c, err := net.ListenUDP(udpNetwork(a), laddr)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
-	b := make([]byte, 2)
-	binary.BigEndian.PutUint16(b, port)
-	_, err = c.Write(b)
+	if opts != nil {
+		if err = setMulticastOptions(c, a, ifi, &opts[0]); err != nil {
+			return err
+		}
+	}
+	_, err = c.WriteTo(b, a)
 	return err
 }
+
+// interfaceAddr returns the address of the interface ifi, found by
+// name, to send packets to the multicast address group from: name
+// itself if it is an address, or else the first address of ifi in the
+// family of group. IPv6 link-local addresses are preferred for
+// link-local groups, and avoided for others.
+func interfaceAddr(ifi *net.Interface, name string, group *net.UDPAddr) (*net.UDPAddr, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ipZone(&net.UDPAddr{IP: ip}, ifi), nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	v4 := group.IP.To4() != nil
+	var found *net.UDPAddr
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() != nil) != v4 {
+			continue
+		}
+		a := ipZone(&net.UDPAddr{IP: ipnet.IP}, ifi)
+		if v4 || ipnet.IP.IsLinkLocalUnicast() == group.IP.IsLinkLocalMulticast() {
+			return a, nil
+		}
+		if found == nil {
+			found = a
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no %s address on network interface %s",
+			udpNetwork(group), ifi.Name)
+	}
+	return found, nil
+}
+
+// ipZone sets the zone of a, if it is an IPv6 link-local address, to
+// the interface ifi.
+func ipZone(a *net.UDPAddr, ifi *net.Interface) *net.UDPAddr {
+	if a.IP.To4() == nil && a.IP.IsLinkLocalUnicast() {
+		a.Zone = ifi.Name
+	}
+	return a
+}
+
+// setMulticastOptions sets the options of a socket that sends packets
+// to the multicast address addr from the interface ifi, if not nil.
+func setMulticastOptions(c *net.UDPConn, addr *net.UDPAddr, ifi *net.Interface, opts *MulticastOptions) error {
+	if addr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(c)
+		if ifi != nil {
+			if err := p.SetMulticastInterface(ifi); err != nil {
+				return err
+			}
+		}
+		if opts.TTL > 0 {
+			if err := p.SetMulticastTTL(opts.TTL); err != nil {
+				return err
+			}
+		}
+		return p.SetMulticastLoopback(!opts.NoLoopback)
+	}
+	p := ipv6.NewPacketConn(c)
+	if ifi != nil {
+		if err := p.SetMulticastInterface(ifi); err != nil {
+			return err
+		}
+	}
+	if opts.TTL > 0 {
+		if err := p.SetMulticastHopLimit(opts.TTL); err != nil {
+			return err
+		}
+	}
+	return p.SetMulticastLoopback(!opts.NoLoopback)
+}
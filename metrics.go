@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets of histograms.
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	widthBuckets   = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128}
+)
+
+// histogram is a Prometheus histogram with the given bucket bounds.
+type histogram struct {
+	counts []uint64 // Observations in each bucket, not cumulative.
+	sum    float64
+	count  uint64
+}
+
+// observe records the value v in h, whose buckets have the upper
+// bounds given.
+func (h *histogram) observe(v float64, buckets []float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	i := sort.SearchFloat64s(buckets, v)
+	if i < len(buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// httpKey identifies the requests of a route in the HTTP metrics.
+type httpKey struct {
+	Route  string
+	Method string
+}
+
+// eventKey identifies upstream events in the registry metrics.
+type eventKey struct {
+	Type   UpstreamEventType
+	Origin string
+}
+
+// metrics holds the metrics of the server that are not kept elsewhere,
+// such as in the statistics of upstream servers.
+type metrics struct {
+	mu       sync.Mutex                 // Guards all the below.
+	requests map[httpKey]map[int]uint64 // Requests by status code.
+	latency  map[httpKey]*histogram     // Duration of requests.
+	events   map[eventKey]uint64        // Upstream events.
+	fanout   histogram                  // Upstream servers per fan-out.
+}
+
+// observeRequest records a request to the given route that returned
+// status and took d.
+func (m *metrics) observeRequest(route, method string, status int, d time.Duration) {
+	k := httpKey{Route: route, Method: method}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[httpKey]map[int]uint64)
+		m.latency = make(map[httpKey]*histogram)
+	}
+	if m.requests[k] == nil {
+		m.requests[k] = make(map[int]uint64)
+		m.latency[k] = new(histogram)
+	}
+	m.requests[k][status]++
+	m.latency[k].observe(d.Seconds(), latencyBuckets)
+}
+
+// observeEvent records an upstream event.
+func (m *metrics) observeEvent(typ UpstreamEventType, origin string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = make(map[eventKey]uint64)
+	}
+	m.events[eventKey{Type: typ, Origin: origin}]++
+}
+
+// observeFanout records a request fanned out to n upstream servers.
+func (m *metrics) observeFanout(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fanout.observe(float64(n), widthBuckets)
+}
+
+// instrument is an http handler that records the requests to f in
+// s.metrics, by the route of s.Handler they match.
+func (s *Server) instrument(f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := responseWriter{ResponseWriter: w, status: http.StatusOK}
+		resp.flusher, _ = w.(http.Flusher)
+		start := time.Now()
+		f.ServeHTTP(&resp, r)
+		var route string
+		if s.Handler != nil {
+			_, route = s.Handler.Handler(r)
+		}
+		if len(route) == 0 {
+			route = "none"
+		}
+		s.metrics.observeRequest(route, methodLabel(r.Method), resp.status, time.Since(start))
+	})
+}
+
+// methodLabel returns the method label of requests with the given
+// method, which is "other" for methods no handler allows, so that
+// callers can't add arbitrary label values.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// handleMetrics returns the metrics of the server in the Prometheus
+// text exposition format.
+func handleMetrics(srv *Server) http.HandlerFunc {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		srv.writeMetrics(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	}
+	return corsHandler(f, "GET")
+}
+
+// writeMetrics writes the metrics of the server to w, in the
+// Prometheus text exposition format.
+func (s *Server) writeMetrics(w io.Writer) {
+	s.metrics.mu.Lock()
+	keys := make([]httpKey, 0, len(s.metrics.requests))
+	for k := range s.metrics.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Route != keys[j].Route {
+			return keys[i].Route < keys[j].Route
+		}
+		return keys[i].Method < keys[j].Method
+	})
+	writeHeader(w, "sv_aggregator_http_requests_total", "counter",
+		"HTTP requests by route, method and status code.")
+	for _, k := range keys {
+		codes := make([]int, 0, len(s.metrics.requests[k]))
+		for code := range s.metrics.requests[k] {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			writeSample(w, "sv_aggregator_http_requests_total",
+				labels("route", k.Route, "method", k.Method, "status", strconv.Itoa(code)),
+				float64(s.metrics.requests[k][code]))
+		}
+	}
+	writeHeader(w, "sv_aggregator_http_request_duration_seconds", "histogram",
+		"Duration of HTTP requests by route and method.")
+	for _, k := range keys {
+		writeHistogram(w, "sv_aggregator_http_request_duration_seconds",
+			labels("route", k.Route, "method", k.Method),
+			s.metrics.latency[k], latencyBuckets)
+	}
+	events := make([]eventKey, 0, len(s.metrics.events))
+	for k := range s.metrics.events {
+		events = append(events, k)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type < events[j].Type
+		}
+		return events[i].Origin < events[j].Origin
+	})
+	writeHeader(w, "sv_aggregator_upstream_discoveries_total", "counter",
+		"Upstream servers discovered or registered, by origin.")
+	for _, k := range events {
+		if k.Type == UpstreamAdded {
+			writeSample(w, "sv_aggregator_upstream_discoveries_total",
+				labels("origin", k.Origin), float64(s.metrics.events[k]))
+		}
+	}
+	writeHeader(w, "sv_aggregator_upstream_deletions_total", "counter",
+		"Upstream servers removed or expired, by origin and reason.")
+	for _, k := range events {
+		if k.Type == UpstreamRemoved || k.Type == UpstreamExpired {
+			writeSample(w, "sv_aggregator_upstream_deletions_total",
+				labels("origin", k.Origin, "reason", k.Type.String()),
+				float64(s.metrics.events[k]))
+		}
+	}
+	writeHeader(w, "sv_aggregator_fanout_width", "histogram",
+		"Upstream servers each request was fanned out to.")
+	writeHistogram(w, "sv_aggregator_fanout_width", "", &s.metrics.fanout, widthBuckets)
+	s.metrics.mu.Unlock()
+
+	rejected := s.RejectedAnnouncements()
+	writeHeader(w, "sv_aggregator_multicast_rejected_total", "counter",
+		"Multicast announcements rejected, by reason.")
+	for _, v := range []struct {
+		reason string
+		n      uint64
+	}{
+		{"malformed", rejected.Malformed},
+		{"unsigned", rejected.Unsigned},
+		{"forged", rejected.Forged},
+		{"replayed", rejected.Replayed},
+	} {
+		writeSample(w, "sv_aggregator_multicast_rejected_total",
+			labels("reason", v.reason), float64(v.n))
+	}
+
+	// Series by upstream server are only written for those still
+	// registered, so that their number stays bounded under churn. The
+	// counters of upstream servers that come back start over.
+	s.mu.RLock()
+	addrs := make([]string, 0, len(s.upstream))
+	stats := make(map[string]upstreamStats, len(s.upstream))
+	for addr, u := range s.upstream {
+		addrs = append(addrs, addr)
+		st := u.Stats
+		st.ErrorsByClass = make(map[string]uint64, len(u.Stats.ErrorsByClass))
+		for class, n := range u.Stats.ErrorsByClass {
+			st.ErrorsByClass[class] = n
+		}
+		st.Latency.counts = append([]uint64(nil), u.Stats.Latency.counts...)
+		stats[addr] = st
+	}
+	s.mu.RUnlock()
+	sort.Strings(addrs)
+	writeHeader(w, "sv_aggregator_upstreams", "gauge",
+		"Upstream servers registered.")
+	writeSample(w, "sv_aggregator_upstreams", "", float64(len(addrs)))
+	writeHeader(w, "sv_aggregator_upstream_requests_total", "counter",
+		"Requests to upstream servers.")
+	for _, addr := range addrs {
+		writeSample(w, "sv_aggregator_upstream_requests_total",
+			labels("upstream", addr), float64(stats[addr].Requests))
+	}
+	writeHeader(w, "sv_aggregator_upstream_errors_total", "counter",
+		"Failed requests to upstream servers, by class of error.")
+	for _, addr := range addrs {
+		classes := make([]string, 0, len(stats[addr].ErrorsByClass))
+		for class := range stats[addr].ErrorsByClass {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			writeSample(w, "sv_aggregator_upstream_errors_total",
+				labels("upstream", addr, "class", class),
+				float64(stats[addr].ErrorsByClass[class]))
+		}
+	}
+	writeHeader(w, "sv_aggregator_upstream_request_duration_seconds", "histogram",
+		"Duration of requests to upstream servers.")
+	for _, addr := range addrs {
+		st := stats[addr]
+		writeHistogram(w, "sv_aggregator_upstream_request_duration_seconds",
+			labels("upstream", addr), &st.Latency, latencyBuckets)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSample writes a sample of a metric with the given labels, as
+// returned by labels.
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if len(labels) > 0 {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// writeHistogram writes the samples of the histogram h with the given
+// labels, whose buckets have the upper bounds given.
+func writeHistogram(w io.Writer, name, lv string, h *histogram, buckets []float64) {
+	prefix := ""
+	if len(lv) > 0 {
+		prefix = lv + ","
+	}
+	var n uint64
+	for i, le := range buckets {
+		if h.counts != nil {
+			n += h.counts[i]
+		}
+		writeSample(w, name+"_bucket",
+			prefix+labels("le", strconv.FormatFloat(le, 'g', -1, 64)), float64(n))
+	}
+	writeSample(w, name+"_bucket", prefix+labels("le", "+Inf"), float64(h.count))
+	writeSample(w, name+"_sum", lv, h.sum)
+	writeSample(w, name+"_count", lv, float64(h.count))
+}
+
+// labelEscaper escapes the values of labels.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats pairs of label names and values.
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Histogram(t *testing.T) {
+	var h histogram
+	for _, v := range []float64{0.5, 1, 3, 100} {
+		h.observe(v, []float64{1, 2, 5})
+	}
+	var b strings.Builder
+	writeHistogram(&b, "h", labels("a", "b"), &h, []float64{1, 2, 5})
+	want := `h_bucket{a="b",le="1"} 2
+h_bucket{a="b",le="2"} 2
+h_bucket{a="b",le="5"} 3
+h_bucket{a="b",le="+Inf"} 4
+h_sum{a="b"} 104.5
+h_count{a="b"} 4
+`
+	if b.String() != want {
+		t.Fatalf("Unexpected histogram. Want:\n%s\nHave:\n%s", want, b.String())
+	}
+}
+
+func TestMetrics_Labels(t *testing.T) {
+	have := labels("a", `x"y`, "b", "1\\2\n")
+	want := `a="x\"y",b="1\\2\n"`
+	if have != want {
+		t.Fatalf("Unexpected labels. Want %s, have %s", want, have)
+	}
+}
+
+func TestMetrics_Endpoint(t *testing.T) {
+	srv := new(Server)
+	mux := http.NewServeMux()
+	mux.Handle("/tables", fakeTables(0))
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.setUpstream(u.Host, nil)
+	srv.registerUpstream("127.0.0.1:1", originAdmin, nil, nil)
+	srv.delUpstream("127.0.0.1:1")
+	srv.recordStats(u.Host, errUnexpectedStatus, time.Second)
+	srv.recordStats(u.Host, errUnexpectedContentType, time.Second)
+	srv.recordStats(u.Host, errUnexpectedResponse, time.Second)
+	srv.recordStats(u.Host, errUnexpectedDocument, time.Second)
+	atomic.AddUint64(&srv.rejected.Malformed, 2)
+	srv.Handler = NewHandler(srv)
+	s := httptest.NewServer(srv.instrument(srv.Handler))
+	defer s.Close()
+	req, err := http.NewRequest("PROPFIND", s.URL+"/tables", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, path := range []string{"/tables", "/tables", "/nowhere", "/metrics"} {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != "/metrics" {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatalf("Unexpected content type: %s", ct)
+		}
+		have := string(b)
+		for _, want := range []string{
+			`sv_aggregator_http_requests_total{route="/tables",method="GET",status="200"} 2`,
+			`sv_aggregator_http_requests_total{route="none",method="GET",status="404"} 1`,
+			`sv_aggregator_http_request_duration_seconds_count{route="/tables",method="GET"} 2`,
+			`sv_aggregator_upstreams 1`,
+			`sv_aggregator_upstream_discoveries_total{origin="multicast"} 1`,
+			`sv_aggregator_upstream_discoveries_total{origin="admin"} 1`,
+			`sv_aggregator_upstream_deletions_total{origin="admin",reason="removed"} 1`,
+			`sv_aggregator_multicast_rejected_total{reason="malformed"} 2`,
+			`sv_aggregator_http_requests_total{route="/tables",method="other",status="405"} 1`,
+			`sv_aggregator_upstream_requests_total{upstream="` + u.Host + `"} 6`,
+			`sv_aggregator_upstream_errors_total{upstream="` + u.Host + `",class="status"} 1`,
+			`sv_aggregator_upstream_errors_total{upstream="` + u.Host + `",class="content_type"} 1`,
+			`sv_aggregator_upstream_errors_total{upstream="` + u.Host + `",class="response"} 1`,
+			`sv_aggregator_upstream_errors_total{upstream="` + u.Host + `",class="document"} 1`,
+			`sv_aggregator_upstream_request_duration_seconds_bucket{upstream="` + u.Host + `",le="0.5"} 2`,
+			`sv_aggregator_fanout_width_bucket{le="1"} 2`,
+			`sv_aggregator_fanout_width_count 2`,
+		} {
+			if !strings.Contains(have, want+"\n") {
+				t.Fatalf("Missing %s in metrics:\n%s", want, have)
+			}
+		}
+		if strings.Contains(have, `upstream="127.0.0.1:1"`) {
+			t.Fatalf("Unexpected series of removed upstream in metrics:\n%s", have)
+		}
+	}
+}
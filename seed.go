@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// StaticDiscoverer is a Discoverer of a fixed list of upstream
+// servers, in form of ip:port.
+type StaticDiscoverer []string
+
+// Discover implements the Discoverer interface.
+func (d StaticDiscoverer) Discover(ctx context.Context, events chan<- DiscoveryEvent) error {
+	for _, addr := range d {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+	}
+	for _, addr := range d {
+		ev := DiscoveryEvent{Type: DiscoveryAdd, Addr: addr, Origin: originStatic}
+		if !sendEvent(ctx, events, ev) {
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// FileDiscoverer is a Discoverer of the upstream servers listed in
+// a file, which is checked for changes every Interval. When the file
+// changes, upstream servers added to it are reported as found and
+// those removed from it as gone. See readUpstreamsFile for the format.
+//
+// Discover returns an error if Interval is not positive, or if the
+// file can't be read the first time. Later errors are logged, and the
+// upstream servers left unchanged.
+type FileDiscoverer struct {
+	Name     string
+	Interval time.Duration
+}
+
+// Discover implements the Discoverer interface.
+func (d *FileDiscoverer) Discover(ctx context.Context, events chan<- DiscoveryEvent) error {
+	if d.Interval <= 0 {
+		return fmt.Errorf("invalid upstreams file interval %s", d.Interval)
+	}
+	fi, err := os.Stat(d.Name)
+	if err != nil {
+		return err
+	}
+	addrs, err := readUpstreamsFile(d.Name)
+	if err != nil {
+		return err
+	}
+	glog.V(1).Infof("loaded %d upstream servers from %s", len(addrs), d.Name)
+	if !syncEvents(ctx, events, originFile, nil, addrs) {
+		return nil
+	}
+	t := time.NewTicker(d.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+		cur, err := os.Stat(d.Name)
+		if err != nil {
+			glog.Errorf("upstreams file: %v", err)
+			continue
+		}
+		if cur.ModTime().Equal(fi.ModTime()) && cur.Size() == fi.Size() {
+			continue
+		}
+		fi = cur
+		next, err := readUpstreamsFile(d.Name)
+		if err != nil {
+			glog.Errorf("upstreams file: %v", err)
+			continue
+		}
+		glog.V(1).Infof("reloaded %d upstream servers from %s", len(next), d.Name)
+		if !syncEvents(ctx, events, originFile, addrs, next) {
+			return nil
+		}
+		addrs = next
+	}
+}
+
+// syncEvents sends events for a list of upstream servers of the given
+// origin that changed from prev to next: the ones in next are reported
+// as found, and the ones only in prev as gone. It returns false if ctx
+// is done before all events are sent.
+func syncEvents(ctx context.Context, events chan<- DiscoveryEvent, origin string, prev, next []string) bool {
+	keep := make(map[string]bool, len(next))
+	for _, addr := range next {
+		keep[addr] = true
+		ev := DiscoveryEvent{Type: DiscoveryAdd, Addr: addr, Origin: origin}
+		if !sendEvent(ctx, events, ev) {
+			return false
+		}
+	}
+	for _, addr := range prev {
+		if keep[addr] {
+			continue
+		}
+		ev := DiscoveryEvent{Type: DiscoveryRemove, Addr: addr, Origin: origin}
+		if !sendEvent(ctx, events, ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// readUpstreamsFile reads a list of upstream servers from a file.
+// The file is either a JSON array of ip:port strings, or plain text
+// with one ip:port per line. Empty lines and lines starting with #
+// are ignored in plain text files.
+func readUpstreamsFile(name string) ([]string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if b = bytes.TrimSpace(b); bytes.HasPrefix(b, []byte("[")) {
+		err = json.Unmarshal(b, &addrs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			addrs = append(addrs, line)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range addrs {
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSeed_Static(t *testing.T) {
+	d := StaticDiscoverer{"127.0.0.1:1111", "127.0.0.1:2222"}
+	evs := collectEvents(t, d, 2)
+	for i, ev := range evs {
+		if ev.Type != DiscoveryAdd || ev.Addr != d[i] || ev.Origin != originStatic {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	}
+	err := StaticDiscoverer{"x"}.Discover(context.Background(), nil)
+	if err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
+
+func TestSeed_ReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	want := []string{"127.0.0.1:1111", "[::1]:2222"}
+	tests := []string{
+		`["127.0.0.1:1111", "[::1]:2222"]`,
+		"# Policy engines.\n127.0.0.1:1111\n\n  [::1]:2222  \n",
+	}
+	name := filepath.Join(dir, "upstreams")
+	for _, tc := range tests {
+		if err = ioutil.WriteFile(name, []byte(tc), 0644); err != nil {
+			t.Fatal(err)
+		}
+		have, err := readUpstreamsFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Fatalf("Unexpected upstreams. Want %v, have %v", want, have)
+		}
+	}
+	if err = ioutil.WriteFile(name, []byte("127.0.0.1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readUpstreamsFile(name); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+	if err = (&FileDiscoverer{Name: name}).Discover(context.Background(), nil); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -15,54 +18,398 @@ type Server struct {
 	Addr          string // Address in form of ip:port to listen on.
 	MulticastAddr string // Multicast address in form of ip:port to listen on.
 
-	mu       sync.RWMutex        // Guards all the below.
-	Handler  *http.ServeMux      // Our request multiplexer.
-	upstream map[string]struct{} // Map of ip:port of upstream servers.
-	usev     chan string         // Upstream server discovery events.
+	// MulticastInterfaces are the names or addresses of the network
+	// interfaces to listen for multicast on. The group is joined on all
+	// of them. Defaults to the interface chosen by the system.
+	MulticastInterfaces []string
+
+	// MulticastKey, if set, is the shared key used to authenticate
+	// multicast announcements. Unsigned announcements are dropped.
+	MulticastKey []byte
+
+	// ReplayWindow is how far from our clock the timestamp of signed
+	// announcements can be. Defaults to one minute.
+	ReplayWindow time.Duration
+
+	// LeaseInterval is the expected interval between announcements
+	// of upstream servers, and LeaseMisses the number of intervals
+	// without announcements after which an upstream server expires.
+	// Upstream servers never expire if either one is zero.
+	LeaseInterval time.Duration
+	LeaseMisses   int
+
+	// HealthPath is the path probed on upstream servers every
+	// HealthInterval. Probes are disabled if either one is not set.
+	HealthPath     string
+	HealthInterval time.Duration
+
+	// FailureThreshold is the number of consecutive failures after
+	// which the circuit of an upstream server opens, for OpenBackoff
+	// at first and doubling on every failed trial up to MaxOpenBackoff.
+	// They default to 3, 5 seconds and one minute, respectively.
+	FailureThreshold int
+	OpenBackoff      time.Duration
+	MaxOpenBackoff   time.Duration
+
+	// FanoutTimeout is how long requests fanned out to all upstream
+	// servers can take overall, and UpstreamTimeout how long each
+	// request to an upstream server can take. They default to 30 and
+	// 10 seconds, respectively.
+	FanoutTimeout   time.Duration
+	UpstreamTimeout time.Duration
+
+	// Transport configures the connections to upstream servers.
+	Transport TransportConfig
+
+	// Scheme is the URL scheme of upstream servers, http or https,
+	// unless they announce https in signed announcements. Defaults
+	// to http.
+	Scheme string
+
+	// Credentials, if set, adds credentials to requests to upstream
+	// servers, and ForwardAuth decides whether the Authorization
+	// header of callers is forwarded instead. Defaults to never.
+	Credentials Credentials
+	ForwardAuth ForwardPolicy
+
+	// InsecureCredentials allows sending credentials to upstream
+	// servers over plain http. They are only sent over https otherwise.
+	InsecureCredentials bool
+
+	// TrustedProxies are the networks of the proxies in front of us.
+	// The forwarding headers of their requests are extended rather
+	// than replaced, see setForwarded.
+	TrustedProxies []*net.IPNet
+
+	// EventsHeartbeat is the interval between heartbeats of the
+	// /upstreams/events stream. Defaults to 15 seconds.
+	EventsHeartbeat time.Duration
+
+	// MinHealthyUpstreams is the number of healthy upstream servers
+	// required for the server to be ready, see readiness.
+	MinHealthyUpstreams int
+
+	// AccessLog, if set, logs every http request. Otherwise they are
+	// logged to the glog info log with -v 1 or higher.
+	AccessLog *AccessLog
+
+	// AdminToken is the bearer token required by requests that change
+	// the list of upstream servers or the tables of upstream servers.
+	// They are refused if it is empty.
+	AdminToken string
+
+	now      func() time.Time      // Clock, for testing. Defaults to time.Now.
+	nonces   nonceCache            // Nonces of signed announcements.
+	rejected RejectedAnnouncements // Updated atomically.
+	metrics  metrics               // See writeMetrics.
+
+	serving       int32 // Listeners being served, updated atomically.
+	discovering   int32 // Discoverers running, updated atomically.
+	noDiscoverers int32 // Set atomically when run without discoverers.
+
+	clientOnce sync.Once    // Creates client.
+	client     *http.Client // Client of upstream servers.
+
+	discoveredOnce sync.Once   // Creates discovered.
+	discovered     chan string // See Discovered.
+
+	submu   sync.Mutex                 // Guards the below.
+	subs    map[*Subscription]struct{} // Subscriptions to upstream events.
+	eventID uint64                     // ID of the last upstream event.
+	history []UpstreamEvent            // Last upstream events.
+
+	mu       sync.RWMutex         // Guards all the below.
+	Handler  *http.ServeMux       // Our request multiplexer.
+	upstream map[string]*upstream // Map of ip:port of upstream servers.
+	http     *http.Server         // Our http server.
+	ctx      context.Context      // Done after Shutdown.
+	cancel   func()               // Cancels ctx.
+}
+
+// upstream holds what we know about an upstream server.
+type upstream struct {
+	Origin       string        // How it was first registered, e.g. multicast.
+	Origins      []string      // Sources vouching for it, see addOrigin.
+	Pinned       bool          // Whether to never remove it automatically.
+	Drained      bool          // Whether to exclude it from fan-out.
+	Announcement *Announcement // Last announcement received, if any.
+	FirstSeen    time.Time     // Time it was first discovered.
+	LastSeen     time.Time     // Time it was last discovered.
+	Health       health        // Circuit breaker.
+	Stats        upstreamStats // Request statistics.
+}
+
+// Origins of upstream servers.
+const (
+	originMulticast = "multicast" // Announced via multicast.
+	originAdmin     = "admin"     // Registered via the admin API.
+	originStatic    = "static"    // Given in the command line.
+	originFile      = "file"      // Listed in the upstreams file.
+	originDNS       = "dns"       // Published in DNS.
+)
+
+// addOrigin records that the source origin vouches for u, and returns
+// whether it did not already. Origins is copied on write, so copies of
+// u made by getUpstream are not changed.
+func (u *upstream) addOrigin(origin string) bool {
+	if u.hasOrigin(origin) {
+		return false
+	}
+	n := len(u.Origins)
+	u.Origins = append(u.Origins[:n:n], origin)
+	if n == 0 {
+		u.Origin = origin
+	}
+	return true
+}
+
+// delOrigin records that the source origin no longer vouches for u,
+// and returns whether it did. Origin is left unchanged when no sources
+// remain, so that pinned upstream servers keep it.
+func (u *upstream) delOrigin(origin string) bool {
+	for i, o := range u.Origins {
+		if o == origin {
+			u.Origins = append(u.Origins[:i:i], u.Origins[i+1:]...)
+			if len(u.Origins) > 0 {
+				u.Origin = u.Origins[0]
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// hasOrigin returns whether the source origin vouches for u.
+func (u *upstream) hasOrigin(origin string) bool {
+	for _, o := range u.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// clock returns the current time.
+func (s *Server) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
 }
 
 // ListenAndServe makes the server start accepting http connections.
+// After Shutdown it returns http.ErrServerClosed.
 func (s *Server) ListenAndServe() error {
-	if glog.V(1) {
-		glog.Infoln("starting http server on", s.Addr)
-		return http.ListenAndServe(s.Addr, httpLog(s.Handler))
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
 	}
-	return http.ListenAndServe(s.Addr, s.Handler)
+	return s.Serve(l)
 }
 
-// setUpstream records the upstream server discovered via multicast
-// and sends its address to the events channel.
-func (s *Server) setUpstream(addr string) {
+// Serve makes the server start accepting http connections on the
+// listener l. After Shutdown it returns http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	glog.V(1).Infoln("starting http server on", l.Addr())
+	atomic.AddInt32(&s.serving, 1)
+	defer atomic.AddInt32(&s.serving, -1)
+	return s.httpServer().Serve(l)
+}
+
+// httpServer returns our http server, creating it if necessary.
+func (s *Server) httpServer() *http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.http == nil {
+		var h http.Handler = s.Handler
+		if s.AccessLog != nil {
+			h = httpLog(h, s.AccessLog)
+		} else if glog.V(1) {
+			h = httpLog(h, &AccessLog{Format: accessFormatGlog})
+		}
+		h = traceHandler(s.instrument(h))
+		s.http = &http.Server{Handler: h}
+	}
+	return s.http
+}
+
+// Shutdown gracefully shuts down the server. It stops the discoverers,
+// then stops accepting http connections and waits for the in-flight
+// requests to finish or ctx to be done, whichever first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.context()
+	s.cancel()
+	return s.httpServer().Shutdown(ctx)
+}
+
+// context returns a context that is done after Shutdown.
+func (s *Server) context() context.Context {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// setUpstream records the upstream server discovered via multicast
+// and publishes an upstream event, unless nothing changed. The
+// announcement a, if not nil, replaces the one previously recorded for
+// the server.
+//
+// Each call renews the lease of the upstream server.
+func (s *Server) setUpstream(addr string, a *Announcement) {
+	now := s.clock()
+	s.mu.Lock()
 	if s.upstream == nil {
-		s.upstream = make(map[string]struct{})
+		s.upstream = make(map[string]*upstream)
 	}
-	if _, ok := s.upstream[addr]; !ok {
+	u, ok := s.upstream[addr]
+	if !ok {
 		glog.V(2).Infof("upstream server discovered: %s", addr)
-		s.upstream[addr] = struct{}{}
+		u = &upstream{FirstSeen: now}
+		s.upstream[addr] = u
 	}
-	// Notify without blocking.
-	if s.usev == nil {
-		s.usev = make(chan string, 1)
+	changed := u.addOrigin(originMulticast)
+	u.LastSeen = now
+	if a != nil {
+		changed = changed || !a.sameAs(u.Announcement)
+		u.Announcement = a
 	}
-	select {
-	case s.usev <- addr:
-	default:
+	switch {
+	case !ok:
+		s.publish(UpstreamAdded, addr, u.Origin)
+	case changed:
+		s.publish(UpstreamUpdated, addr, u.Origin)
 	}
+	s.mu.Unlock()
+}
+
+// upstreamScheme returns the URL scheme of the given upstream server.
+// Upstream servers can only announce https, which is ignored unless
+// the announcement was verified, so that they can't downgrade it.
+func (s *Server) upstreamScheme(addr string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if u, ok := s.upstream[addr]; ok && u.Announcement != nil &&
+		u.Announcement.Verified && u.Announcement.Scheme == "https" {
+		return "https"
+	}
+	if len(s.Scheme) > 0 {
+		return s.Scheme
+	}
+	return "http"
+}
+
+// hasUpstream returns whether the given upstream server is in the
+// internal list.
+func (s *Server) hasUpstream(addr string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.upstream[addr]
+	return ok
+}
+
+// getUpstream returns a copy of what we know about the given upstream
+// server, or nil if it is not in the internal list.
+func (s *Server) getUpstream(addr string) *upstream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.upstream[addr]
+	if !ok {
+		return nil
+	}
+	c := *u
+	return &c
 }
 
 // delUpstream removes the given upstream from the internal list.
 func (s *Server) delUpstream(addr string) {
 	glog.V(2).Infof("upstream server deleted: %s", addr)
 	s.mu.Lock()
-	if s.upstream != nil {
+	defer s.mu.Unlock()
+	if u, ok := s.upstream[addr]; ok {
 		delete(s.upstream, addr)
+		s.publish(UpstreamRemoved, addr, u.Origin)
+	}
+}
+
+// delDiscoveredUpstream records that the given origin no longer vouches
+// for the given upstream, and removes it from the internal list if no
+// other origin does, unless it is pinned.
+func (s *Server) delDiscoveredUpstream(addr, origin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstream[addr]
+	if !ok || !u.delOrigin(origin) {
+		return
+	}
+	if len(u.Origins) > 0 || u.Pinned {
+		s.publish(UpstreamUpdated, addr, u.Origin)
+		return
+	}
+	glog.V(2).Infof("upstream server deleted: %s", addr)
+	delete(s.upstream, addr)
+	s.publish(UpstreamRemoved, addr, origin)
+}
+
+// registerUpstream records the upstream server registered by other
+// means than multicast, or updates it and adds origin to its origins if
+// it is already known, publishing an upstream event unless nothing
+// changed. Nil flags are left unchanged. It returns whether the
+// upstream server was created.
+func (s *Server) registerUpstream(addr, origin string, pinned, drained *bool) bool {
+	now := s.clock()
+	s.mu.Lock()
+	if s.upstream == nil {
+		s.upstream = make(map[string]*upstream)
+	}
+	u, ok := s.upstream[addr]
+	if !ok {
+		glog.V(2).Infof("upstream server registered: %s", addr)
+		u = &upstream{FirstSeen: now, LastSeen: now}
+		s.upstream[addr] = u
+	}
+	changed := u.addOrigin(origin)
+	changed = u.setFlags(pinned, drained) || changed
+	switch {
+	case !ok:
+		s.publish(UpstreamAdded, addr, u.Origin)
+	case changed:
+		s.publish(UpstreamUpdated, addr, u.Origin)
 	}
 	s.mu.Unlock()
+	return !ok
 }
 
-// upstreamList returns a list of all upstreams currently available.
+// updateUpstream updates the flags of the given upstream server, and
+// publishes an upstream event if any changed. Nil flags are left
+// unchanged. It returns false if the upstream server is not in the
+// internal list.
+func (s *Server) updateUpstream(addr string, pinned, drained *bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstream[addr]
+	if ok && u.setFlags(pinned, drained) {
+		s.publish(UpstreamUpdated, addr, u.Origin)
+	}
+	return ok
+}
+
+// setFlags sets the flags of u that are not nil, and returns whether
+// any of them changed.
+func (u *upstream) setFlags(pinned, drained *bool) bool {
+	changed := false
+	if pinned != nil && u.Pinned != *pinned {
+		u.Pinned, changed = *pinned, true
+	}
+	if drained != nil && u.Drained != *drained {
+		u.Drained, changed = *drained, true
+	}
+	return changed
+}
+
+// upstreamList returns a sorted list of all upstreams currently available.
 func (s *Server) upstreamList() []string {
 	s.mu.RLock()
 	i := 0
@@ -72,43 +419,157 @@ func (s *Server) upstreamList() []string {
 		i++
 	}
 	s.mu.RUnlock()
+	sort.Strings(peers)
+	return peers
+}
+
+// fanoutList returns a sorted list of all upstreams that are not drained.
+func (s *Server) fanoutList() []string {
+	s.mu.RLock()
+	peers := make([]string, 0, len(s.upstream))
+	for addr, u := range s.upstream {
+		if !u.Drained {
+			peers = append(peers, addr)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(peers)
 	return peers
 }
 
 // foreachUpstream loops over each upstream server calling f in its own
-// goroutine. In case f returns an error, the upstream server is removed
-// from the internal list.
-func (s *Server) foreachUpstream(f func(addr string) error) {
-	var err error
+// goroutine. Upstream servers that are drained or whose circuit is
+// open are skipped, and the error returned by f is recorded in their
+// circuit breaker and request statistics. It returns the upstream
+// servers skipped because their circuit is open.
+//
+// The context passed to f is done after the given timeout, or the
+// default s.UpstreamTimeout if zero, and all of them are done after
+// s.FanoutTimeout or when ctx is done. Errors caused by ctx being
+// cancelled, such as when the client goes away, are not recorded in
+// the circuit breakers.
+func (s *Server) foreachUpstream(ctx context.Context, timeout time.Duration, f func(ctx context.Context, addr string) error) []string {
+	if timeout <= 0 {
+		timeout = s.upstreamTimeout()
+	}
+	fctx, cancel := context.WithTimeout(ctx, s.fanoutTimeout())
+	defer cancel()
 	var wg sync.WaitGroup
-	for _, addr := range s.upstreamList() {
+	var skipped []string
+	n := 0
+	for _, addr := range s.fanoutList() {
+		if !s.allowRequest(addr) {
+			glog.V(2).Infof("skipping upstream server with open circuit: %s", addr)
+			skipped = append(skipped, addr)
+			continue
+		}
+		n++
 		wg.Add(1)
 		go func(addr string) {
-			if err = f(addr); err != nil {
-				s.delUpstream(addr)
+			defer wg.Done()
+			uctx, cancel := context.WithTimeout(fctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := f(uctx, addr)
+			s.recordStats(addr, err, time.Since(start))
+			if err != nil && ctx.Err() == context.Canceled {
+				// Not the upstream server's fault, but give back
+				// the half-open trial slot, if it took one.
+				s.releaseTrial(addr)
+				return
 			}
-			wg.Done()
+			s.recordResult(addr, err)
 		}(addr)
 	}
+	s.metrics.observeFanout(n)
 	wg.Wait()
+	return skipped
 }
 
-// httpLog logs http requests.
-func httpLog(f http.Handler) http.Handler {
+// Defaults for the fan-out configuration of Server.
+const (
+	defaultFanoutTimeout   = 30 * time.Second
+	defaultUpstreamTimeout = 10 * time.Second
+)
+
+func (s *Server) fanoutTimeout() time.Duration {
+	if s.FanoutTimeout > 0 {
+		return s.FanoutTimeout
+	}
+	return defaultFanoutTimeout
+}
+
+func (s *Server) upstreamTimeout() time.Duration {
+	if s.UpstreamTimeout > 0 {
+		return s.UpstreamTimeout
+	}
+	return defaultUpstreamTimeout
+}
+
+// readiness is the response of the /readyz endpoint.
+type readiness struct {
+	Ready       bool // Whether all of the below are.
+	Serving     bool // Whether the http server is accepting connections.
+	Discovering bool // Whether the discoverers are running, if any.
+
+	Upstreams           int // Registered upstream servers.
+	HealthyUpstreams    int // Healthy upstream servers, not drained.
+	MinHealthyUpstreams int // Required healthy upstream servers.
+}
+
+// readiness returns whether the server is ready to handle requests:
+// its http server and discoverers, if any, are running, and at least
+// s.MinHealthyUpstreams upstream servers are healthy.
+func (s *Server) readiness() *readiness {
+	r := &readiness{
+		Serving:             atomic.LoadInt32(&s.serving) > 0,
+		MinHealthyUpstreams: s.MinHealthyUpstreams,
+	}
+	// Without discoverers there is nothing to wait for, upstream
+	// servers are registered via the admin API.
+	r.Discovering = atomic.LoadInt32(&s.noDiscoverers) > 0 ||
+		atomic.LoadInt32(&s.discovering) > 0
+	s.mu.RLock()
+	r.Upstreams = len(s.upstream)
+	for _, u := range s.upstream {
+		if u.Health.State == stateHealthy && !u.Drained {
+			r.HealthyUpstreams++
+		}
+	}
+	s.mu.RUnlock()
+	r.Ready = r.Serving && r.Discovering &&
+		r.HealthyUpstreams >= r.MinHealthyUpstreams
+	return r
+}
+
+// httpLog logs http requests to l, with their request and trace IDs
+// if they have a trace context, see traceHandler.
+func httpLog(f http.Handler, l *AccessLog) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		resp := responseWriter{ResponseWriter: w, status: http.StatusOK}
+		resp.flusher, _ = w.(http.Flusher)
 		start := time.Now()
-		f.ServeHTTP(&resp, r)
-		elapsed := time.Since(start)
-		glog.Infof("%s %d %q %q %s %db %s",
-			r.Proto,
-			resp.status,
-			r.Method,
-			r.URL.Path,
-			remoteIP(r),
-			resp.bytes,
-			elapsed,
-		)
+		fanout := new(fanoutCounters)
+		ctx := context.WithValue(r.Context(), fanoutKey{}, fanout)
+		f.ServeHTTP(&resp, r.WithContext(ctx))
+		e := &accessEntry{
+			Time:      start,
+			RemoteIP:  remoteIP(r),
+			Proto:     r.Proto,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Status:    resp.status,
+			Bytes:     resp.bytes,
+			Duration:  milliseconds(time.Since(start)),
+			UserAgent: r.UserAgent(),
+			Referer:   r.Referer(),
+			Upstreams: int(atomic.LoadInt64(&fanout.upstreams)),
+			Failed:    int(atomic.LoadInt64(&fanout.failed)),
+		}
+		if tc := traceFromContext(r.Context()); tc != nil {
+			e.RequestID, e.TraceID = tc.RequestID, tc.TraceID
+		}
+		l.log(e)
 	})
 }
 
@@ -145,3 +606,11 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.status = code
 	w.ResponseWriter.WriteHeader(code)
 }
+
+// Flush implements the http.Flusher interface, if the underlying
+// http.ResponseWriter does.
+func (w *responseWriter) Flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,6 +15,7 @@ func TestServer_Discovery(t *testing.T) {
 	s := &Server{
 		MulticastAddr: "224.0.0.1:8888",
 	}
+	sub := s.Subscribe(0)
 	ready := make(chan struct{})
 	go s.Discover(ready)
 	<-ready
@@ -19,7 +24,8 @@ func TestServer_Discovery(t *testing.T) {
 		t.Fatal(err)
 	}
 	select {
-	case peer := <-s.Discovered():
+	case ev := <-sub.C:
+		peer := ev.Addr
 		_, port, err := net.SplitHostPort(peer)
 		if err != nil {
 			t.Fatal(err)
@@ -32,19 +38,400 @@ func TestServer_Discovery(t *testing.T) {
 	}
 }
 
+func TestServer_DiscoveryAnnouncement(t *testing.T) {
+	s := &Server{
+		MulticastAddr: "224.0.0.1:8889",
+	}
+	sub := s.Subscribe(0)
+	ready := make(chan struct{})
+	go s.Discover(ready)
+	<-ready
+	err := MulticastAnnounce(s.MulticastAddr, &Announcement{
+		Port:   2222,
+		NodeID: "pts-1",
+		Labels: map[string]string{"site": "a"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-sub.C:
+		peer := ev.Addr
+		u := s.getUpstream(peer)
+		if u == nil || u.Announcement == nil {
+			t.Fatalf("Missing announcement for %s", peer)
+		}
+		a := u.Announcement
+		if a.Port != 2222 || a.NodeID != "pts-1" || a.Labels["site"] != "a" {
+			t.Fatalf("Unexpected announcement: %+v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No peer discovered")
+	}
+}
+
+func TestServer_DiscoveryAuthenticated(t *testing.T) {
+	key := []byte("secret")
+	s := &Server{
+		MulticastAddr: "224.0.0.1:8890",
+		MulticastKey:  key,
+	}
+	sub := s.Subscribe(0)
+	ready := make(chan struct{})
+	go s.Discover(ready)
+	<-ready
+	if err := MulticastPing(s.MulticastAddr, 1111); err != nil {
+		t.Fatal(err)
+	}
+	a := &Announcement{Port: 2222}
+	if err := MulticastAnnounce(s.MulticastAddr, a, []byte("forged")); err != nil {
+		t.Fatal(err)
+	}
+	if err := MulticastAnnounce(s.MulticastAddr, a, key); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-sub.C:
+		peer := ev.Addr
+		_, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != "2222" {
+			t.Fatalf("Unexpected port. Want 2222, have %s", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No peer discovered")
+	}
+	r := s.RejectedAnnouncements()
+	if r.Unsigned != 1 || r.Forged != 1 {
+		t.Fatalf("Unexpected rejections: %+v", r)
+	}
+}
+
+func TestServer_AuthenticateReplay(t *testing.T) {
+	key := []byte("secret")
+	s := &Server{MulticastKey: key, ReplayWindow: time.Second}
+	b, err := (&Announcement{Port: 1111}).Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a Announcement
+	if err = a.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.authenticate(b, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.authenticate(b, &a); err != errReplayed {
+		t.Fatalf("Unexpected error for replayed packet: %v", err)
+	}
+	a.Timestamp = a.Timestamp.Add(-time.Hour)
+	a.Nonce = []byte("fresh")
+	if err = s.authenticate(b, &a); err != errReplayed {
+		t.Fatalf("Unexpected error for stale packet: %v", err)
+	}
+	if r := s.RejectedAnnouncements(); r.Replayed != 2 {
+		t.Fatalf("Unexpected # of replays. Want 2, have %d", r.Replayed)
+	}
+}
+
 func TestServer_Upstream(t *testing.T) {
 	s := &Server{}
-	s.setUpstream("a")
-	s.setUpstream("b")
-	s.setUpstream("c")
-	s.foreachUpstream(func(s string) error {
-		if s == "a" {
-			// This forces a call to s.delUpstream.
-			return errors.New("failed")
-		}
-		return nil
+	s.setUpstream("a", nil)
+	s.setUpstream("b", nil)
+	s.setUpstream("c", nil)
+	calls := make(chan string, 3*defaultFailureThreshold+3)
+	for i := 0; i <= defaultFailureThreshold; i++ {
+		s.foreachUpstream(ctx, 0, func(ctx context.Context, s string) error {
+			calls <- s
+			if s == "a" {
+				// This opens the circuit of a, eventually.
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+	if len(s.upstreamList()) != 3 {
+		t.Fatalf("Unexpected # of upstreams. Want 3, have %d", len(s.upstream))
+	}
+	if n := len(calls); n != 3*defaultFailureThreshold+2 {
+		t.Fatalf("Unexpected # of calls. Want %d, have %d",
+			3*defaultFailureThreshold+2, n)
+	}
+	if st := s.upstreamStates()["a"]; st != stateOpen {
+		t.Fatalf("Unexpected state of a. Want open, have %s", st)
+	}
+}
+
+func TestServer_DiscoveryGoodbye(t *testing.T) {
+	s := &Server{
+		MulticastAddr: "224.0.0.1:8891",
+	}
+	sub := s.Subscribe(0)
+	ready := make(chan struct{})
+	go s.Discover(ready)
+	<-ready
+	a := &Announcement{Port: 3333}
+	if err := MulticastAnnounce(s.MulticastAddr, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := waitEvent(t, sub, UpstreamAdded).Addr
+	a.Goodbye = true
+	if err := MulticastAnnounce(s.MulticastAddr, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitEvent(t, sub, UpstreamRemoved); ev.Addr != peer {
+		t.Fatalf("Unexpected peer removed. Want %s, have %s", peer, ev.Addr)
+	}
+	if s.getUpstream(peer) != nil {
+		t.Fatal("Peer not removed after goodbye")
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	inflight := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{
+		MulticastAddr: "224.0.0.1:8892",
+		Handler:       http.NewServeMux(),
+	}
+	s.Handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		close(inflight)
+		<-release
+		w.Write([]byte("ok"))
 	})
-	if len(s.upstreamList()) != 2 {
-		t.Fatalf("Unexpected # of upstreams. Want 2, have %d", len(s.upstream))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	ready := make(chan struct{})
+	discovered := make(chan error, 1)
+	go func() { discovered <- s.Discover(ready) }()
+	<-ready
+	resp := make(chan string, 1)
+	go func() {
+		r, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		resp <- string(b)
+	}()
+	<-inflight
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	if err = <-discovered; err != nil {
+		t.Fatalf("Unexpected error from Discover: %v", err)
+	}
+	select {
+	case err = <-shutdown:
+		t.Fatalf("Shutdown returned with requests in-flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if b := <-resp; b != "ok" {
+		t.Fatalf("Unexpected response. Want ok, have %q", b)
+	}
+	if err = <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Fatalf("Unexpected error from Serve: %v", err)
+	}
+}
+
+func TestServer_DelDiscoveredUpstream(t *testing.T) {
+	s := &Server{}
+	yes := true
+	s.setUpstream("a", nil)
+	s.setUpstream("b", nil)
+	s.updateUpstream("b", &yes, nil)
+	s.registerUpstream("c", originStatic, nil, nil)
+	for _, addr := range []string{"a", "b", "c"} {
+		s.delDiscoveredUpstream(addr, originMulticast)
+	}
+	if l := s.upstreamList(); len(l) != 2 || l[0] != "b" || l[1] != "c" {
+		t.Fatalf("Unexpected upstreams. Want [b c], have %v", l)
+	}
+}
+
+func TestServer_PeerAddr(t *testing.T) {
+	tests := []struct {
+		src  *net.UDPAddr
+		want string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, "10.0.0.1:1111"},
+		{&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 5000}, "[fd00::1]:1111"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, "[fe80::1%eth0]:1111"},
+	}
+	for _, tc := range tests {
+		if have := peerAddr(tc.src, 1111); have != tc.want {
+			t.Fatalf("Unexpected peer. Want %s, have %s", tc.want, have)
+		}
+	}
+}
+
+// multicastInterface returns an interface that supports IPv6 multicast,
+// or skips the test if there is none.
+func multicastInterface(t *testing.T) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip, ok := addr.(*net.IPNet); ok && ip.IP.IsLinkLocalUnicast() &&
+				ip.IP.To4() == nil {
+				return &ifi
+			}
+		}
+	}
+	t.Skip("No interface with IPv6 multicast")
+	return nil
+}
+
+func TestServer_DiscoveryIPv6(t *testing.T) {
+	ifi := multicastInterface(t)
+	s := &Server{
+		MulticastAddr: "[ff02::114%" + ifi.Name + "]:8893",
+	}
+	sub := s.Subscribe(0)
+	ready := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() { errc <- s.Discover(ready) }()
+	select {
+	case <-ready:
+	case err := <-errc:
+		t.Skipf("Cannot listen for IPv6 multicast: %v", err)
+	}
+	if err := MulticastPing(s.MulticastAddr, 1111); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-sub.C:
+		peer := ev.Addr
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := net.ParseIP(strings.Split(host, "%")[0]); ip == nil || ip.To4() != nil {
+			t.Fatalf("Unexpected peer. Want IPv6 address, have %s", peer)
+		}
+		if port != "1111" {
+			t.Fatalf("Unexpected port. Want 1111, have %s", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No peer discovered")
+	}
+}
+
+// multicastInterface4 returns an interface that supports IPv4 multicast
+// and its address, or skips the test if there is none.
+func multicastInterface4(t *testing.T) (*net.Interface, net.IP) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip, ok := addr.(*net.IPNet); ok && ip.IP.To4() != nil {
+				return &ifi, ip.IP
+			}
+		}
+	}
+	t.Skip("No interface with IPv4 multicast")
+	return nil, nil
+}
+
+func TestServer_FindInterface(t *testing.T) {
+	ifi, ip := multicastInterface4(t)
+	for _, name := range []string{ifi.Name, ip.String()} {
+		have, err := findInterface(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Name != ifi.Name {
+			t.Fatalf("Unexpected interface for %s. Want %s, have %s",
+				name, ifi.Name, have.Name)
+		}
+	}
+	if _, err := findInterface("192.0.2.1"); err == nil {
+		t.Fatal("Unexpected interface for unassigned address")
+	}
+}
+
+func TestServer_MulticastSource(t *testing.T) {
+	ifi, ip := multicastInterface4(t)
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 1), Port: 8895}
+	l, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	opts := MulticastOptions{Interface: ifi.Name, TTL: 1}
+	if err = MulticastPing(group.String(), 1111, opts); err != nil {
+		t.Fatal(err)
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, maxDatagramSize)
+	_, src, err := l.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !src.IP.Equal(ip) {
+		t.Fatalf("Unexpected source address. Want %s, have %s", ip, src.IP)
+	}
+}
+
+func TestServer_DiscoveryInterface(t *testing.T) {
+	ifi, ip := multicastInterface4(t)
+	s := &Server{
+		MulticastAddr:       "224.0.0.1:8894",
+		MulticastInterfaces: []string{ifi.Name},
+	}
+	sub := s.Subscribe(0)
+	ready := make(chan struct{})
+	go s.Discover(ready)
+	<-ready
+	opts := MulticastOptions{Interface: ip.String(), TTL: 1}
+	if err := MulticastPing(s.MulticastAddr, 1111, opts); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-sub.C:
+		peer := ev.Addr
+		if _, port, _ := net.SplitHostPort(peer); port != "1111" {
+			t.Fatalf("Unexpected peer. Want port 1111, have %s", peer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No peer discovered")
+	}
+	opts.NoLoopback = true
+	if err := MulticastPing(s.MulticastAddr, 2222, opts); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("Unexpected event without loopback: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
 	}
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// latencySamples is the number of latest request latencies kept for
+// each upstream server to compute percentiles.
+const latencySamples = 128
+
+// upstreamStats holds request statistics of an upstream server.
+type upstreamStats struct {
+	Requests  uint64 // Requests made to the upstream server.
+	Errors    uint64 // Requests that failed.
+	LastError string // Error of the last failed request.
+
+	ErrorsByClass map[string]uint64 // Failed requests, see errorClass.
+	Latency       histogram         // Duration of requests, in seconds.
+
+	ConnsNew    uint64 // Requests made on newly dialed connections.
+	ConnsReused uint64 // Requests made on reused connections.
+
+	latencies [latencySamples]time.Duration // Ring buffer.
+	next      int                           // Next index in latencies.
+	samples   int                           // Samples in latencies.
+}
+
+// add records the result of a request that took d.
+func (st *upstreamStats) add(err error, d time.Duration) {
+	st.Requests++
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+		if st.ErrorsByClass == nil {
+			st.ErrorsByClass = make(map[string]uint64)
+		}
+		st.ErrorsByClass[errorClass(err)]++
+	}
+	st.Latency.observe(d.Seconds(), latencyBuckets)
+	st.latencies[st.next] = d
+	st.next = (st.next + 1) % latencySamples
+	if st.samples < latencySamples {
+		st.samples++
+	}
+}
+
+// percentiles returns the given latency percentiles, in the range
+// [0, 100], using the nearest-rank method.
+func (st *upstreamStats) percentiles(p ...float64) []time.Duration {
+	v := make([]time.Duration, len(p))
+	if st.samples == 0 {
+		return v
+	}
+	d := make([]time.Duration, st.samples)
+	copy(d, st.latencies[:st.samples])
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	for i := range p {
+		rank := int(p[i]/100*float64(len(d))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(d) {
+			rank = len(d) - 1
+		}
+		v[i] = d[rank]
+	}
+	return v
+}
+
+// recordStats records the result of a request made to the given
+// upstream server, that took d.
+func (s *Server) recordStats(addr string, err error, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.upstream[addr]; ok {
+		u.Stats.add(err, d)
+	}
+}
+
+// upstreamInfo is the representation of an upstream server in the
+// responses of the /upstreams endpoint.
+type upstreamInfo struct {
+	Addr      string
+	Origin    string
+	Origins   []string
+	Pinned    bool
+	Drained   bool
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Source    string            `json:",omitempty"`
+	NodeID    string            `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	State     healthState
+	Requests  uint64
+	Errors    uint64
+	LastError string `json:",omitempty"`
+	Latency   latencyInfo
+	Conns     connInfo
+}
+
+// connInfo holds the number of requests made on new and reused
+// connections, to check that connections are kept alive.
+type connInfo struct {
+	New    uint64
+	Reused uint64
+}
+
+// latencyInfo holds latency percentiles in milliseconds.
+type latencyInfo struct {
+	P50 float64
+	P90 float64
+	P99 float64
+}
+
+// upstreamInfos returns information about all upstream servers,
+// sorted by address.
+func (s *Server) upstreamInfos() []*upstreamInfo {
+	s.mu.RLock()
+	infos := make([]*upstreamInfo, 0, len(s.upstream))
+	for addr, u := range s.upstream {
+		infos = append(infos, u.info(addr))
+	}
+	s.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos
+}
+
+// getUpstreamInfo returns information about the given upstream server,
+// or nil if it is not in the internal list.
+func (s *Server) getUpstreamInfo(addr string) *upstreamInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.upstream[addr]
+	if !ok {
+		return nil
+	}
+	return u.info(addr)
+}
+
+// info returns information about u, with the given address.
+func (u *upstream) info(addr string) *upstreamInfo {
+	info := &upstreamInfo{
+		Addr:      addr,
+		Origin:    u.Origin,
+		Origins:   u.Origins,
+		Pinned:    u.Pinned,
+		Drained:   u.Drained,
+		FirstSeen: u.FirstSeen,
+		LastSeen:  u.LastSeen,
+		State:     u.Health.State,
+		Requests:  u.Stats.Requests,
+		Errors:    u.Stats.Errors,
+		LastError: u.Stats.LastError,
+		Conns: connInfo{
+			New:    u.Stats.ConnsNew,
+			Reused: u.Stats.ConnsReused,
+		},
+	}
+	if a := u.Announcement; a != nil {
+		info.Source = a.Source
+		info.NodeID = a.NodeID
+		info.Labels = a.Labels
+	}
+	p := u.Stats.percentiles(50, 90, 99)
+	info.Latency = latencyInfo{
+		P50: milliseconds(p[0]),
+		P90: milliseconds(p[1]),
+		P99: milliseconds(p[2]),
+	}
+	return info
+}
+
+// recordConn records whether the connection of a request made to the
+// given upstream server was reused.
+func (s *Server) recordConn(addr string, reused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.upstream[addr]
+	if !ok {
+		return
+	}
+	if reused {
+		u.Stats.ConnsReused++
+	} else {
+		u.Stats.ConnsNew++
+	}
+}
+
+// milliseconds returns d in milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
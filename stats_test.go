@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStats_Percentiles(t *testing.T) {
+	var st upstreamStats
+	if p := st.percentiles(50); p[0] != 0 {
+		t.Fatalf("Unexpected percentile without samples: %s", p[0])
+	}
+	for i := 1; i <= 100; i++ {
+		st.add(nil, time.Duration(i)*time.Millisecond)
+	}
+	st.add(errors.New("failed"), time.Second)
+	if st.Requests != 101 || st.Errors != 1 || st.LastError != "failed" {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+	p := st.percentiles(0, 50, 99, 100)
+	want := []time.Duration{
+		time.Millisecond,
+		51 * time.Millisecond,
+		100 * time.Millisecond,
+		time.Second,
+	}
+	for i := range want {
+		if p[i] != want[i] {
+			t.Fatalf("Unexpected percentiles. Want %v, have %v", want, p)
+		}
+	}
+}
+
+func TestStats_RingBuffer(t *testing.T) {
+	var st upstreamStats
+	for i := 0; i < latencySamples; i++ {
+		st.add(nil, time.Hour)
+	}
+	for i := 0; i < latencySamples; i++ {
+		st.add(nil, time.Second)
+	}
+	if p := st.percentiles(100); p[0] != time.Second {
+		t.Fatalf("Unexpected max latency. Want 1s, have %s", p[0])
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// errPinMismatch is returned when the certificate of an upstream server
+// does not match its pin.
+var errPinMismatch = errors.New("certificate does not match pin")
+
+// loadTLSConfig returns the TLS configuration of connections to upstream
+// servers. The certificates of upstream servers are verified with the
+// CAs in the PEM file caFile, or the system CAs if empty. If certFile
+// and keyFile are set, they are the PEM files of the client certificate
+// and key presented to upstream servers, for mutual TLS.
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// parsePins parses the certificate pins of upstream servers, given as
+// a map of addresses to the base64 encoded SHA-256 hash of the subject
+// public key info of their certificates.
+func parsePins(m map[string]string) (map[string][]byte, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	pins := make(map[string][]byte, len(m))
+	for addr, v := range m {
+		pin, err := base64.StdEncoding.DecodeString(v)
+		if err == nil && len(pin) != sha256.Size {
+			err = errors.New("not a SHA-256 hash")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin of %s: %v", addr, err)
+		}
+		pins[addr] = pin
+	}
+	return pins, nil
+}
+
+// certificatePin returns the pin of cert, see parsePins.
+func certificatePin(cert *x509.Certificate) []byte {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return h[:]
+}
+
+// hostTransports holds the transports of upstream servers that need
+// their own TLS configuration, because their certificate is pinned or
+// they have a different server name.
+type hostTransports struct {
+	mu sync.Mutex
+	m  map[string]*http.Transport
+}
+
+// get returns the transport of the upstream server at addr, creating
+// it from base if necessary, or nil if it can use base.
+func (h *hostTransports) get(addr string, base *http.Transport, c *TransportConfig) *http.Transport {
+	name, pin := c.ServerNames[addr], c.Pins[addr]
+	if len(name) == 0 && pin == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.m[addr]; ok {
+		return t
+	}
+	t := base.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	if len(name) > 0 {
+		t.TLSClientConfig.ServerName = name
+	}
+	if pin != nil {
+		t.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 ||
+				!bytes.Equal(certificatePin(cs.PeerCertificates[0]), pin) {
+				return errPinMismatch
+			}
+			return nil
+		}
+	}
+	if h.m == nil {
+		h.m = make(map[string]*http.Transport)
+	}
+	h.m[addr] = t
+	return t
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes the given DER blocks as PEM to a file in dir.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	name = filepath.Join(dir, name)
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// newClientCert creates a self-signed client certificate, and writes
+// it and its key to files in dir.
+func newClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aggregator"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert,
+		writePEM(t, dir, "client.pem", "CERTIFICATE", der),
+		writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// newTLSUpstream starts a fake upstream server over TLS, requiring
+// client certificates signed by clientCA if not nil. It returns the
+// server, its address and the file of its CA.
+func newTLSUpstream(t *testing.T, dir string, clientCA *x509.Certificate) (*httptest.Server, string, string) {
+	mux := http.NewServeMux()
+	mux.Handle("/tables", fakeTables(0))
+	upstream := httptest.NewUnstartedServer(mux)
+	if clientCA != nil {
+		upstream.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  x509.NewCertPool(),
+		}
+		upstream.TLS.ClientCAs.AddCert(clientCA)
+	}
+	upstream.StartTLS()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := writePEM(t, dir, "ca.pem", "CERTIFICATE", upstream.Certificate().Raw)
+	return upstream, u.Host, ca
+}
+
+func TestTLS_LoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := loadTLSConfig("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RootCAs != nil || len(c.Certificates) != 0 {
+		t.Fatalf("Unexpected TLS config: %+v", c)
+	}
+	_, cert, key := newClientCert(t, dir)
+	c, err = loadTLSConfig(cert, cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RootCAs == nil || len(c.Certificates) != 1 {
+		t.Fatalf("Unexpected TLS config: %+v", c)
+	}
+	if _, err = loadTLSConfig(key, "", ""); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+	if _, err = loadTLSConfig("", cert, ""); err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
+
+func TestTLS_ParsePins(t *testing.T) {
+	pin := make([]byte, 32)
+	pin[0] = 1
+	pins, err := parsePins(map[string]string{
+		"127.0.0.1:1111": base64.StdEncoding.EncodeToString(pin),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || pins["127.0.0.1:1111"][0] != 1 {
+		t.Fatalf("Unexpected pins: %v", pins)
+	}
+	tests := []string{"not base64", base64.StdEncoding.EncodeToString(pin[:16])}
+	for _, tc := range tests {
+		if _, err = parsePins(map[string]string{"127.0.0.1:1111": tc}); err == nil {
+			t.Fatalf("Expected error didn't occur with pin %q", tc)
+		}
+	}
+}
+
+func TestTLS_Tables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, addr, ca := newTLSUpstream(t, dir, nil)
+	defer upstream.Close()
+	c, err := loadTLSConfig(ca, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Scheme: "https", Transport: TransportConfig{TLS: c}}
+	srv.setUpstream(addr, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var env aggregateEnvelope
+	if err = json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Complete || len(env.Results) != 1 ||
+		env.Results[0].URL != "https://"+addr+"/tables" {
+		t.Fatalf("Unexpected response: %+v", env)
+	}
+}
+
+func TestTLS_AnnouncedScheme(t *testing.T) {
+	srv := &Server{Scheme: "https"}
+	srv.setUpstream("127.0.0.1:1111", &Announcement{Scheme: "http", Verified: true})
+	srv.setUpstream("127.0.0.1:2222", nil)
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1:1111", "https"},
+		{"127.0.0.1:2222", "https"},
+		{"127.0.0.1:3333", "https"},
+	}
+	for _, tc := range tests {
+		if have := srv.upstreamScheme(tc.addr); have != tc.want {
+			t.Fatalf("Unexpected scheme of %s. Want %s, have %s",
+				tc.addr, tc.want, have)
+		}
+	}
+
+	srv = new(Server)
+	srv.setUpstream("127.0.0.1:1111", &Announcement{Scheme: "https", Verified: true})
+	srv.setUpstream("127.0.0.1:2222", &Announcement{Scheme: "https"})
+	srv.setUpstream("127.0.0.1:3333", &Announcement{Scheme: "gopher", Verified: true})
+	tests = []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1:1111", "https"},
+		{"127.0.0.1:2222", "http"},
+		{"127.0.0.1:3333", "http"},
+		{"127.0.0.1:4444", "http"},
+	}
+	for _, tc := range tests {
+		if have := srv.upstreamScheme(tc.addr); have != tc.want {
+			t.Fatalf("Unexpected scheme of %s. Want %s, have %s",
+				tc.addr, tc.want, have)
+		}
+	}
+}
+
+func TestTLS_UnknownCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, addr, _ := newTLSUpstream(t, dir, nil)
+	defer upstream.Close()
+	srv := new(Server)
+	_, err = getTables(context.Background(), srv.httpClient(),
+		upstreamURL("https", addr, "/tables"))
+	if err == nil {
+		t.Fatal("Expected error didn't occur")
+	}
+}
+
+func TestTLS_MutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clientCA, cert, key := newClientCert(t, dir)
+	upstream, addr, ca := newTLSUpstream(t, dir, clientCA)
+	defer upstream.Close()
+	url := upstreamURL("https", addr, "/tables")
+
+	c, err := loadTLSConfig(ca, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Transport: TransportConfig{TLS: c}}
+	if _, err = getTables(context.Background(), srv.httpClient(), url); err == nil {
+		t.Fatal("Expected error didn't occur without client certificate")
+	}
+
+	c, err = loadTLSConfig(ca, cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = &Server{Transport: TransportConfig{TLS: c}}
+	if _, err = getTables(context.Background(), srv.httpClient(), url); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS_PinAndServerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, addr, ca := newTLSUpstream(t, dir, nil)
+	defer upstream.Close()
+	url := upstreamURL("https", addr, "/tables")
+	c, err := loadTLSConfig(ca, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := certificatePin(upstream.Certificate())
+	bad := make([]byte, len(good))
+	tests := []struct {
+		name string
+		pin  []byte
+		ok   bool
+	}{
+		{"", good, true},
+		{"", bad, false},
+		{"example.com", nil, true},
+		{"other.example.org", nil, false},
+	}
+	for _, tc := range tests {
+		srv := &Server{Transport: TransportConfig{TLS: c}}
+		if len(tc.name) > 0 {
+			srv.Transport.ServerNames = map[string]string{addr: tc.name}
+		}
+		if tc.pin != nil {
+			srv.Transport.Pins = map[string][]byte{addr: tc.pin}
+		}
+		_, err := getTables(context.Background(), srv.httpClient(), url)
+		if tc.ok && err != nil {
+			t.Fatalf("Unexpected error with name %q and pin %x: %v",
+				tc.name, tc.pin, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("Expected error didn't occur with name %q and pin %x",
+				tc.name, tc.pin)
+		}
+	}
+}
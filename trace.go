@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// traceContext identifies an incoming request across the aggregator
+// and the upstream servers it queries, with its X-Request-ID header
+// and its W3C trace context. See https://www.w3.org/TR/trace-context/.
+type traceContext struct {
+	RequestID string // X-Request-ID of the request.
+	TraceID   string // Trace the request is part of, in hex.
+	ParentID  string // Span of the caller, in hex, if any.
+	SpanID    string // Our span for the request, in hex.
+	Flags     string // Trace flags, in hex.
+	State     string // Vendor specific tracestate header, if any.
+}
+
+// maxRequestIDLen is the maximum length of X-Request-ID headers we
+// accept from callers. Longer ones are replaced.
+const maxRequestIDLen = 128
+
+// newTraceContext returns the trace context of the incoming request
+// r. It takes the X-Request-ID and traceparent headers of r if they
+// are valid, and starts a new trace otherwise. Either way it has a
+// new span of its own.
+func newTraceContext(r *http.Request) *traceContext {
+	tc := &traceContext{
+		RequestID: r.Header.Get("X-Request-ID"),
+		SpanID:    randomHex(8),
+		Flags:     "01",
+	}
+	if !validRequestID(tc.RequestID) {
+		tc.RequestID = randomHex(16)
+	}
+	traceID, parentID, flags, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if ok {
+		tc.TraceID, tc.ParentID, tc.Flags = traceID, parentID, flags
+		tc.State = r.Header.Get("tracestate")
+	} else {
+		tc.TraceID = randomHex(16)
+	}
+	return tc
+}
+
+// traceparent returns the traceparent header of a request made in the
+// given span of the trace.
+func (tc *traceContext) traceparent(spanID string) string {
+	return "00-" + tc.TraceID + "-" + spanID + "-" + tc.Flags
+}
+
+// setHeaders sets the X-Request-ID and trace context headers of req,
+// a request to an upstream server, in a new child span of ours. It
+// returns the ID of the child span.
+func (tc *traceContext) setHeaders(req *http.Request) string {
+	spanID := randomHex(8)
+	req.Header.Set("X-Request-ID", tc.RequestID)
+	req.Header.Set("traceparent", tc.traceparent(spanID))
+	if len(tc.State) > 0 {
+		req.Header.Set("tracestate", tc.State)
+	}
+	return spanID
+}
+
+// parseTraceparent parses a traceparent header of version 00, or a
+// later version as per the specification, returning its trace ID,
+// parent ID and trace flags in lowercase hex.
+func parseTraceparent(v string) (traceID, parentID, flags string, ok bool) {
+	p := strings.Split(strings.TrimSpace(v), "-")
+	if len(p) < 4 || len(p[0]) != 2 || p[0] == "ff" || !isHex(p[0]) {
+		return "", "", "", false
+	}
+	if p[0] == "00" && len(p) != 4 {
+		return "", "", "", false
+	}
+	traceID, parentID, flags = p[1], p[2], p[3]
+	if len(traceID) != 32 || !isHex(traceID) || isZeroHex(traceID) ||
+		len(parentID) != 16 || !isHex(parentID) || isZeroHex(parentID) ||
+		len(flags) != 2 || !isHex(flags) {
+		return "", "", "", false
+	}
+	return traceID, parentID, flags, true
+}
+
+// isHex returns whether s only has lowercase hex digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isZeroHex returns whether s only has zeros, which is invalid in
+// trace and span IDs.
+func isZeroHex(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// validRequestID returns whether id is a request ID we accept from
+// callers: not empty, not too long, and only printable ASCII.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// traceKey is the context key of the trace context.
+type traceKey struct{}
+
+// traceFromContext returns the trace context carried by ctx, or nil if
+// there is none.
+func traceFromContext(ctx context.Context) *traceContext {
+	tc, _ := ctx.Value(traceKey{}).(*traceContext)
+	return tc
+}
+
+// traceHandler is an http handler that assigns a trace context to each
+// request, see newTraceContext, and makes it available to f and to the
+// requests to upstream servers made on its behalf. The X-Request-ID of
+// the request is returned in the response.
+func traceHandler(f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc := newTraceContext(r)
+		w.Header().Set("X-Request-ID", tc.RequestID)
+		glog.V(3).Infof("request %s in trace %s span %s, parent %s",
+			tc.RequestID, tc.TraceID, tc.SpanID, tc.ParentID)
+		ctx := context.WithValue(r.Context(), traceKey{}, tc)
+		f.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
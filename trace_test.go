@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTrace_ParseTraceparent(t *testing.T) {
+	tests := []struct {
+		v  string
+		ok bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		_, _, _, ok := parseTraceparent(tc.v)
+		if ok != tc.ok {
+			t.Fatalf("Unexpected result parsing %q. Want %v, have %v",
+				tc.v, tc.ok, ok)
+		}
+	}
+}
+
+func TestTrace_NewTraceContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/tables", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	r.Header.Set("tracestate", "vendor=value")
+	tc := newTraceContext(r)
+	if tc.RequestID != "abc-123" ||
+		tc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		tc.ParentID != "00f067aa0ba902b7" ||
+		tc.Flags != "00" ||
+		tc.State != "vendor=value" ||
+		len(tc.SpanID) != 16 || tc.SpanID == tc.ParentID {
+		t.Fatalf("Unexpected trace context: %+v", tc)
+	}
+
+	r = httptest.NewRequest("GET", "/tables", nil)
+	r.Header.Set("X-Request-ID", strings.Repeat("x", maxRequestIDLen+1))
+	r.Header.Set("traceparent", "garbage")
+	r.Header.Set("tracestate", "vendor=value")
+	tc = newTraceContext(r)
+	if len(tc.RequestID) != 32 || len(tc.TraceID) != 32 ||
+		len(tc.ParentID) != 0 || tc.Flags != "01" || len(tc.State) != 0 {
+		t.Fatalf("Unexpected trace context: %+v", tc)
+	}
+}
+
+func TestTrace_Upstream(t *testing.T) {
+	var mu sync.Mutex
+	var headers []http.Header
+	srv := new(Server)
+	for i := 0; i < 3; i++ {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/tables", func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			headers = append(headers, r.Header)
+			mu.Unlock()
+			fakeTables(0)(w, r)
+		})
+		upstream := httptest.NewServer(mux)
+		defer upstream.Close()
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.setUpstream(u.Host, nil)
+	}
+	s := httptest.NewServer(traceHandler(NewHandler(srv)))
+	defer s.Close()
+	req, err := http.NewRequest("GET", s.URL+"/tables", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "abc-123")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have := resp.Header.Get("X-Request-ID"); have != "abc-123" {
+		t.Fatalf("Unexpected X-Request-ID in response: %q", have)
+	}
+	if len(headers) != 3 {
+		t.Fatalf("Unexpected number of upstream requests: %d", len(headers))
+	}
+	spans := make(map[string]bool)
+	for _, h := range headers {
+		if have := h.Get("X-Request-ID"); have != "abc-123" {
+			t.Fatalf("Unexpected X-Request-ID upstream: %q", have)
+		}
+		traceID, spanID, flags, ok := parseTraceparent(h.Get("traceparent"))
+		if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+			spanID == "00f067aa0ba902b7" || flags != "01" {
+			t.Fatalf("Unexpected traceparent upstream: %q", h.Get("traceparent"))
+		}
+		spans[spanID] = true
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Unexpected span IDs. Want 3 different, have %v", spans)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TransportConfig configures the connections to upstream servers.
+// Zero values select the defaults.
+type TransportConfig struct {
+	MaxIdleConnsPerHost int           // Idle connections kept per upstream, default 16.
+	MaxConnsPerHost     int           // Connections per upstream, unlimited if zero.
+	IdleConnTimeout     time.Duration // How long idle connections are kept, default 90s.
+	DialTimeout         time.Duration // How long connecting can take, default 5s.
+	TLSHandshakeTimeout time.Duration // How long TLS handshakes can take, default 5s.
+	HTTP2               bool          // Whether to try HTTP/2 over TLS.
+
+	// TLS is the configuration of TLS connections, see loadTLSConfig.
+	// ServerNames overrides the server name used to verify the
+	// certificate of some upstream servers, and sent with SNI, and Pins
+	// the hash their certificate must have, see parsePins. Both are
+	// keyed by the address of the upstream servers.
+	TLS         *tls.Config
+	ServerNames map[string]string
+	Pins        map[string][]byte
+}
+
+// Defaults for TransportConfig.
+const (
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = 5 * time.Second
+	defaultTLSHandshakeTimeout = 5 * time.Second
+)
+
+// newTransport returns an http.Transport configured by c.
+func (c *TransportConfig) newTransport() *http.Transport {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		IdleConnTimeout:     c.IdleConnTimeout,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+		ForceAttemptHTTP2:   c.HTTP2,
+	}
+	if c.TLS != nil {
+		t.TLSClientConfig = c.TLS.Clone()
+	}
+	if t.MaxIdleConnsPerHost <= 0 {
+		t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if t.IdleConnTimeout <= 0 {
+		t.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if t.TLSHandshakeTimeout <= 0 {
+		t.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	dialTimeout := c.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	t.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	return t
+}
+
+// httpClient returns the client used to make requests to upstream
+// servers, creating it from s.Transport the first time.
+func (s *Server) httpClient() *http.Client {
+	s.clientOnce.Do(func() {
+		s.client = &http.Client{
+			Transport: &upstreamTransport{
+				s:    s,
+				base: s.Transport.newTransport(),
+			},
+			// Redirects are not followed, so that credentials are
+			// never sent to the servers they point to.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+	return s.client
+}
+
+// upstreamTransport is the http.RoundTripper of requests to upstream
+// servers. It adds their credentials, forwarding and trace context
+// headers, see Server.authorize, Server.setForwarded and traceContext,
+// and records whether their connections are reused.
+type upstreamTransport struct {
+	s     *Server
+	base  *http.Transport
+	hosts hostTransports
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.s.recordConn(addr, info.Reused)
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	req = req.Clone(ctx)
+	if in := incomingRequest(ctx); in != nil {
+		t.s.setForwarded(req, in)
+	}
+	if tc := traceFromContext(ctx); tc != nil {
+		spanID := tc.setHeaders(req)
+		glog.V(2).Infof("request %s to %s in trace %s span %s, parent %s",
+			tc.RequestID, req.URL, tc.TraceID, spanID, tc.SpanID)
+	}
+	if err := t.s.authorize(req, addr); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	rt := t.base
+	if h := t.hosts.get(addr, t.base, &t.s.Transport); h != nil {
+		rt = h
+	}
+	return rt.RoundTrip(req)
+}
+
+// incomingKey is the context key of the incoming request.
+type incomingKey struct{}
+
+// withIncoming returns the context of the incoming request r, carrying
+// r itself, for the requests to upstream servers made on its behalf.
+func withIncoming(r *http.Request) context.Context {
+	return context.WithValue(r.Context(), incomingKey{}, r)
+}
+
+// incomingRequest returns the incoming request carried by ctx, or nil
+// if the request to an upstream server was not made on behalf of one.
+func incomingRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(incomingKey{}).(*http.Request)
+	return r
+}
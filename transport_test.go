@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTransport_Config(t *testing.T) {
+	c := &TransportConfig{MaxConnsPerHost: 4, HTTP2: true}
+	tr := c.newTransport()
+	if tr.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost ||
+		tr.MaxConnsPerHost != 4 ||
+		tr.IdleConnTimeout != defaultIdleConnTimeout ||
+		tr.TLSHandshakeTimeout != defaultTLSHandshakeTimeout ||
+		!tr.ForceAttemptHTTP2 {
+		t.Fatalf("Unexpected transport: %+v", tr)
+	}
+	c = &TransportConfig{
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     time.Second,
+		TLSHandshakeTimeout: time.Second,
+	}
+	tr = c.newTransport()
+	if tr.MaxIdleConnsPerHost != 2 ||
+		tr.IdleConnTimeout != time.Second ||
+		tr.TLSHandshakeTimeout != time.Second ||
+		tr.ForceAttemptHTTP2 {
+		t.Fatalf("Unexpected transport: %+v", tr)
+	}
+}
+
+func TestTransport_ConnReuse(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tables", fakeTables(3))
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := new(Server)
+	srv.setUpstream(u.Host, nil)
+	s := httptest.NewServer(NewHandler(srv))
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(s.URL + "/tables")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected server response: %s", resp.Status)
+		}
+	}
+	info := srv.getUpstreamInfo(u.Host)
+	if info.Conns.New != 1 || info.Conns.Reused != 4 {
+		t.Fatalf("Unexpected connections. Want 1 new and 4 reused, have %+v",
+			info.Conns)
+	}
+}